@@ -0,0 +1,346 @@
+//go:build integration
+
+/*! \file integration_test.go
+    \brief Runs toggle against real redis-server processes, killing and pausing them to make sure failover does what it should
+
+    go test -tags integration ./integration/
+
+    Needs redis-server in the path, and 127.0.0.2 on the loopback (every linux box has it) since the main and subordinate
+    have to be on different ips with the same ports.  nginx isn't needed, toggle renders into a temp dir and "reloads" by
+    appending to a file.
+*/
+
+package integration
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    mainIP      = "127.0.0.1"
+    subIP       = "127.0.0.2"
+    token       = "integration"
+    waitFor     = time.Second * 30  //longest we'll wait for toggle to notice something
+)
+
+var toggleBin string    //built once in TestMain
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type redisProc_t struct {
+    ip      string
+    port    int
+    dir     string
+    cmd     *exec.Cmd
+}
+
+type toggle_t struct {
+    dir         string
+    config      string
+    nginxFile   string
+    reloads     string
+    api         string
+    cmd         *exec.Cmd
+}
+
+//just what we need out of the config file toggle writes
+type config_t struct {
+    Main struct {
+        PublicIP    string  `json:"public_ip"`
+    } `json:"main"`
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- HELPERS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func TestMain (m *testing.M) {
+    if _, err := exec.LookPath("redis-server"); err != nil {
+        fmt.Println("redis-server isn't installed, skipping integration tests")
+        os.Exit(0)
+    }
+    if l, err := net.Listen("tcp", subIP + ":0"); err != nil {
+        fmt.Printf("Can't listen on %s, skipping integration tests :: %s\n", subIP, err.Error())
+        os.Exit(0)
+    } else {
+        l.Close()
+    }
+
+    dir, err := ioutil.TempDir("", "toggle-integration")
+    if err != nil { panic(err) }
+    toggleBin = filepath.Join(dir, "toggle")
+    if out, err := exec.Command("go", "build", "-o", toggleBin, "../toggle").CombinedOutput(); err != nil {
+        fmt.Printf("Unable to build toggle :: %s\n%s", err.Error(), out)
+        os.Exit(1)
+    }
+
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+//returns a port that's free on both ips
+func freePort (t *testing.T) int {
+    t.Helper()
+    for i := 0; i < 20; i++ {
+        l, err := net.Listen("tcp", mainIP + ":0")
+        if err != nil { t.Fatal(err) }
+        port := l.Addr().(*net.TCPAddr).Port
+        l.Close()
+
+        if l2, err := net.Listen("tcp", fmt.Sprintf("%s:%d", subIP, port)); err == nil {
+            l2.Close()
+            return port
+        }
+    }
+    t.Fatal("Couldn't find a port that's free on both ips")
+    return 0
+}
+
+//keeps checking until the function stops returning an error
+func eventually (t *testing.T, what string, fn func () error) {
+    t.Helper()
+    var err error
+    for deadline := time.Now().Add(waitFor); time.Now().Before(deadline); time.Sleep(time.Millisecond * 200) {
+        if err = fn(); err == nil { return }
+    }
+    t.Fatalf("Timed out waiting for %s :: %v", what, err)
+}
+
+func startRedis (t *testing.T, ip string, port int) *redisProc_t {
+    t.Helper()
+    r := &redisProc_t{ ip: ip, port: port, dir: t.TempDir() }
+    r.start(t)
+    t.Cleanup(r.kill)
+    return r
+}
+
+func (r *redisProc_t) start (t *testing.T) {
+    t.Helper()
+    r.cmd = exec.Command("redis-server", "--bind", r.ip, "--port", fmt.Sprint(r.port), "--save", "", "--appendonly", "no", "--dir", r.dir)
+    if err := r.cmd.Start(); err != nil { t.Fatal(err) }
+
+    eventually(t, fmt.Sprintf("redis on %s:%d to start", r.ip, r.port), func () error {
+        _, err := r.role()
+        return err
+    })
+}
+
+func (r *redisProc_t) kill () {
+    if r.cmd == nil || r.cmd.Process == nil { return }
+    r.cmd.Process.Signal(syscall.SIGCONT)   //in case it was stopped
+    r.cmd.Process.Kill()
+    r.cmd.Wait()
+    r.cmd = nil
+}
+
+//freezes the process, which to toggle looks the same as the network to it going away
+func (r *redisProc_t) stop () { r.cmd.Process.Signal(syscall.SIGSTOP) }
+func (r *redisProc_t) cont () { r.cmd.Process.Signal(syscall.SIGCONT) }
+
+func (r *redisProc_t) client () (*redis.Redis_c, error) {
+    c := &redis.Redis_c{ PoolSize: 1, Timeouts: redis.Timeouts_t{ DialMs: 500, ReadMs: 500, WriteMs: 500 } }
+    return c, c.Connect(r.ip, r.port)
+}
+
+func (r *redisProc_t) role () (redis.Role_t, error) {
+    c, err := r.client()
+    if err != nil { return redis.Role_t{}, err }
+    defer c.Close()
+    return c.Role()
+}
+
+//errors until the server is the main
+func (r *redisProc_t) isMain () error {
+    role, err := r.role()
+    if err != nil { return err }
+    if !role.Main { return fmt.Errorf("%s:%d is replicating from %s:%d", r.ip, r.port, role.MainHost, role.MainPort) }
+    return nil
+}
+
+//errors until the server is replicating from the ip passed in, with the link up
+func (r *redisProc_t) replicates (from string) error {
+    role, err := r.role()
+    if err != nil { return err }
+    if role.Main || role.MainHost != from || role.MainPort != r.port || !role.LinkUp {
+        return fmt.Errorf("%s:%d has role %+v, wanted it replicating from %s", r.ip, r.port, role, from)
+    }
+    return nil
+}
+
+func startToggle (t *testing.T, ports []int) *toggle_t {
+    t.Helper()
+    tg := &toggle_t{ dir: t.TempDir() }
+    tg.config = filepath.Join(tg.dir, "toggle.conf")
+    tg.nginxFile = filepath.Join(tg.dir, "nginx", "tcpconf.d", "toggle")
+    tg.reloads = filepath.Join(tg.dir, "reloads")
+
+    portList := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(ports)), ","), "[]")
+    timeouts := `"timeouts":{"dial_ms":500,"read_ms":500,"write_ms":500}`
+    conf := fmt.Sprintf(`{"main":{"public_ip":"%s",%s},"subordinate":{"public_ip":"%s",%s},"ports":[%s]}`, mainIP, timeouts, subIP, timeouts, portList)
+    if err := ioutil.WriteFile(tg.config, []byte(conf), 0644); err != nil { t.Fatal(err) }
+
+    apiPort := freePort(t)
+    tg.api = fmt.Sprintf("http://%s:%d", mainIP, apiPort)
+    tg.cmd = exec.Command(toggleBin, "-c", tg.config, "-i", "1", "-r", "1", "-p", fmt.Sprint(apiPort), "-token", token, "-graceful", "5",
+        "-backups", "0", "-nginx-dir", filepath.Join(tg.dir, "nginx"), "-nginx-reload", fmt.Sprintf("echo reload >> %s", tg.reloads))
+    tg.cmd.Stdout, tg.cmd.Stderr = os.Stdout, os.Stderr
+    if err := tg.cmd.Start(); err != nil { t.Fatal(err) }
+    t.Cleanup(func () {
+        tg.cmd.Process.Signal(os.Interrupt)
+        tg.cmd.Wait()
+    })
+
+    eventually(t, "toggle's api", func () error {
+        _, err := tg.request("GET", "/status")
+        return err
+    })
+    return tg
+}
+
+func (tg *toggle_t) request (method, path string) ([]byte, error) {
+    req, err := http.NewRequest(method, tg.api + path, nil)
+    if err != nil { return nil, err }
+    req.Header.Set("Authorization", "Bearer " + token)
+
+    resp, err := (&http.Client{ Timeout: time.Minute }).Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err == nil && resp.StatusCode > 299 { err = fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, body) }
+    return body, err
+}
+
+//errors until the config file says the ip passed in is the main
+func (tg *toggle_t) configMain (ip string) error {
+    byt, err := ioutil.ReadFile(tg.config)
+    if err != nil { return err }
+    var config config_t
+    if err = json.Unmarshal(byt, &config); err != nil { return err }
+    if config.Main.PublicIP != ip { return fmt.Errorf("Config has %s as the main", config.Main.PublicIP) }
+    return nil
+}
+
+//errors until nginx is rendered pointing every port at the ip passed in, and has been reloaded
+func (tg *toggle_t) nginxMain (ip string, ports []int) error {
+    byt, err := ioutil.ReadFile(tg.nginxFile)
+    if err != nil { return err }
+    for _, port := range ports {
+        if !strings.Contains(string(byt), fmt.Sprintf("server %s:%d", ip, port)) || !strings.Contains(string(byt), fmt.Sprintf("listen %d;", port)) {
+            return fmt.Errorf("nginx isn't pointing port %d at %s:\n%s", port, ip, byt)
+        }
+    }
+    if _, err := os.Stat(tg.reloads); err != nil { return fmt.Errorf("nginx was never reloaded") }
+    return nil
+}
+
+//starts a main and subordinate on each of n ports, and toggle watching them
+func setup (t *testing.T, n int) (ports []int, mains, subs []*redisProc_t, tg *toggle_t) {
+    t.Helper()
+    for i := 0; i < n; i++ {
+        port := freePort(t)
+        ports = append(ports, port)
+        mains = append(mains, startRedis(t, mainIP, port))
+        subs = append(subs, startRedis(t, subIP, port))
+    }
+
+    tg = startToggle(t, ports)
+    for _, s := range subs {    //toggle points the subordinates at the main when it starts
+        eventually(t, "the subordinate to replicate", func () error { return s.replicates(mainIP) })
+    }
+    eventually(t, "nginx pointing at the main", func () error { return tg.nginxMain(mainIP, ports) })
+    return
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- TESTS -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func TestStartup (t *testing.T) {
+    ports, mains, _, tg := setup(t, 2)
+    for _, m := range mains {
+        if err := m.isMain(); err != nil { t.Fatal(err) }
+    }
+    if err := tg.configMain(mainIP); err != nil { t.Fatal(err) }
+
+    byt, _ := ioutil.ReadFile(tg.nginxFile)
+    for _, port := range ports {
+        if !strings.Contains(string(byt), fmt.Sprintf("upstream redis_%d {", port)) { t.Fatalf("No upstream for port %d:\n%s", port, byt) }
+    }
+}
+
+func TestFailoverOnKill (t *testing.T) {
+    ports, mains, subs, tg := setup(t, 2)
+    mains[0].kill()     //one port going down moves every port
+
+    for _, s := range subs {
+        eventually(t, "the subordinate to be promoted", s.isMain)
+    }
+    eventually(t, "the config to be rewritten", func () error { return tg.configMain(subIP) })
+    eventually(t, "nginx to point at the new main", func () error { return tg.nginxMain(subIP, ports) })
+    eventually(t, "the old main on the other port to be demoted", func () error { return mains[1].replicates(subIP) })
+
+    mains[0].start(t)   //comes back as a main, toggle keeps trying until it can demote it
+    eventually(t, "the old main to be demoted once it's back", func () error { return mains[0].replicates(subIP) })
+}
+
+func TestFailoverOnPartition (t *testing.T) {
+    ports, mains, subs, tg := setup(t, 1)
+    mains[0].stop()     //it still accepts connections, it just never answers
+
+    eventually(t, "the subordinate to be promoted", subs[0].isMain)
+    eventually(t, "the config to be rewritten", func () error { return tg.configMain(subIP) })
+    eventually(t, "nginx to point at the new main", func () error { return tg.nginxMain(subIP, ports) })
+
+    mains[0].cont()
+    eventually(t, "the old main to be demoted once it's reachable", func () error { return mains[0].replicates(subIP) })
+}
+
+func TestBothDown (t *testing.T) {
+    _, mains, subs, tg := setup(t, 1)
+    subs[0].kill()
+    mains[0].kill()
+
+    time.Sleep(time.Second * 5) //a few checks
+    if err := tg.configMain(mainIP); err != nil { t.Fatalf("Switched with nothing to switch to :: %s", err.Error()) }
+}
+
+func TestGracefulSwitch (t *testing.T) {
+    ports, mains, subs, tg := setup(t, 1)
+
+    c, err := mains[0].client()
+    if err != nil { t.Fatal(err) }
+    if err = c.Set("integration", "before the switch"); err != nil { t.Fatal(err) }
+    c.Close()
+
+    if _, err = tg.request("POST", "/switch"); err != nil { t.Fatal(err) }
+
+    if err = subs[0].isMain(); err != nil { t.Fatal(err) }
+    if err = tg.configMain(subIP); err != nil { t.Fatal(err) }
+    if err = tg.nginxMain(subIP, ports); err != nil { t.Fatal(err) }
+    eventually(t, "the old main to be demoted", func () error { return mains[0].replicates(subIP) })
+
+    c, err = subs[0].client()
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    if val, err := c.Get("integration"); err != nil || val != "before the switch" { t.Fatalf("Lost the write across the switch: %q %v", val, err) }
+}
@@ -9,8 +9,11 @@ import (
     "log"
     "os"
     "os/exec"
+    "path/filepath"
     "io/ioutil"
     "bytes"
+    "regexp"
+    "sort"
     "text/template"
 )
 
@@ -22,14 +25,26 @@ const nginx_dir     = "/etc/nginx"
 const nginx_tcp_dir = "tcpconf.d"
 const conf_file     = "toggle"
 
+var timeRegex = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|M|y)?$`)  //nginx time units
+
 const upstreamProxy = `
     upstream redis_{{.Port}} {
-        server {{.IP}}:{{.Port}};
+{{- with .Resolver}}
+        zone redis_{{$.Port}} 64k;
+        resolver {{.}}{{with $.ResolverValid}} valid={{.}}{{end}};
+{{- end}}
+        server {{.IP}}:{{.Port}}{{with .MaxFails}} max_fails={{.}}{{end}}{{with .FailTimeout}} fail_timeout={{.}}{{end}}{{if .Resolver}} resolve{{end}};
     }
 
     server {
         listen {{.Port}};
         proxy_pass redis_{{.Port}};
+{{- with .ConnectTimeout}}
+        proxy_connect_timeout {{.}};
+{{- end}}
+{{- with .ProxyTimeout}}
+        proxy_timeout {{.}};
+{{- end}}
     }
 
 `
@@ -38,33 +53,74 @@ const upstreamProxy = `
  //----- STRUCT ------------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+//settings for the generated config, these are passed along from the main toggle to any subordinates
+type Options_t struct {
+    Template        string  `json:"template,omitempty" yaml:"template,omitempty" toml:"template,omitempty"`   //path to a template file to use instead of the built in one
+    TemplateText    string  `json:"template_text,omitempty" yaml:"template_text,omitempty" toml:"template_text,omitempty"` //the template itself, see Inline
+    MaxFails        int     `json:"max_fails,omitempty" yaml:"max_fails,omitempty" toml:"max_fails,omitzero"`
+    FailTimeout     string  `json:"fail_timeout,omitempty" yaml:"fail_timeout,omitempty" toml:"fail_timeout,omitempty"`
+    ConnectTimeout  string  `json:"connect_timeout,omitempty" yaml:"connect_timeout,omitempty" toml:"connect_timeout,omitempty"`
+    ProxyTimeout    string  `json:"proxy_timeout,omitempty" yaml:"proxy_timeout,omitempty" toml:"proxy_timeout,omitempty"`
+    Resolver        string  `json:"resolver,omitempty" yaml:"resolver,omitempty" toml:"resolver,omitempty"`  //when set nginx gets hostnames and resolves them itself
+    ResolverValid   string  `json:"resolver_valid,omitempty" yaml:"resolver_valid,omitempty" toml:"resolver_valid,omitempty"`
+}
+
 type Nginx_c struct {
     TestingFlag bool
+    Options     Options_t
+    Dir         string      //where nginx keeps its config, nginx_dir when not set
+    Reload      string      //shell command that reloads nginx, systemctl when not set
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Returns the template we're rendering for each port, either the built in one or the one from our options
+    A template file that doesn't exist here falls back to the built in one, so a subordinate without it still renders
+*/
+func (n *Nginx_c) template () (*template.Template, error) {
+    text := upstreamProxy
+    if len(n.Options.TemplateText) > 0 {
+        text = n.Options.TemplateText
+    } else if len(n.Options.Template) > 0 {
+        byt, err := ioutil.ReadFile(n.Options.Template)
+        if os.IsNotExist(err) {
+            log.Printf("Nginx template %s doesn't exist, using the built in one\n", n.Options.Template)
+        } else if err != nil {
+            return nil, fmt.Errorf("Unable to read nginx template %s :: %s", n.Options.Template, err.Error())
+        } else {
+            text = string(byt)
+        }
+    }
+    return template.New("upstream").Parse(text)
+}
+
 /*! \brief This generates a string that represents the config file for nginx to pass requests to the upstream ip and port
 */
-func (n *Nginx_c) genStream (ip string, port int) string {
+func (n *Nginx_c) genStream (tmpl *template.Template, ip string, port int) (string, error) {
     var data struct {
         IP string
         Port int
+        Options_t
     }
     data.IP = ip
     data.Port = port
+    data.Options_t = n.Options
     
     buf := new(bytes.Buffer)
-    err := template.Must(template.New("upstream").Parse(upstreamProxy)).Execute(buf, data)
-    if err != nil {
-        log.Println(err)
-    }
-    return buf.String()
+    err := tmpl.Execute(buf, data)
+    return buf.String(), err
 }
 
 func (n *Nginx_c) reload() {
+    if len(n.Reload) > 0 {  //we've been told how
+        if out, err := exec.Command("sh", "-c", n.Reload).CombinedOutput(); err != nil {
+            log.Printf("Unable to reload nginx with %q: %s %s", n.Reload, err.Error(), out)
+        }
+        return
+    }
+
     _, err := exec.LookPath("nginx")
     if err == nil { //nginx is installed, so go with it
         cmd := exec.Command("systemctl", "reload", "nginx")
@@ -81,23 +137,83 @@ func (n *Nginx_c) reload() {
  //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Returns where the config file we write lives
+*/
+func (n *Nginx_c) File () string {
+    dir := n.Dir
+    if len(dir) == 0 { dir = nginx_dir }
+    return filepath.Join(dir, nginx_tcp_dir, conf_file)
+}
+
+/*! \brief Returns the config file we'd write for these ports pointing at this ip, without writing it
+*/
+func (n *Nginx_c) Render (ip string, ports []int) (string, error) {
+    tmpl, err := n.template()
+    if err != nil { return "", err }
+
+    content := ""
+    for _, p := range ports {
+        stream, err := n.genStream(tmpl, ip, p)
+        if err != nil { return "", err }
+        content += stream
+    }
+    return content, nil
+}
+
 /*! \brief Main entry point, this handles setting of the nginx config file and ensuring it's enabled and nginx has it reloaded
 */
 func (n *Nginx_c) Set (ip string, ports []int) error {
+    content, err := n.Render(ip, ports)
+    if err != nil { return err }
 
-    err := os.MkdirAll(fmt.Sprintf("%s/%s", nginx_dir, nginx_tcp_dir), 0755)   //create the directory to store the config file in
+    err = os.MkdirAll(filepath.Dir(n.File()), 0755)   //create the directory to store the config file in
+    if err != nil { return err }
 
-    if err == nil { //we have a dir, now let's dump to file
-        fileName := fmt.Sprintf("%s/%s/%s", nginx_dir, nginx_tcp_dir, conf_file)
-        content := ""
-        for _, p := range ports {
-            content += n.genStream(ip, p)
-            ioutil.WriteFile(fileName, []byte(content), 0644)
-        }
+    //we have a dir, now let's dump to file
+    err = ioutil.WriteFile(n.File(), []byte(content), 0644)
+    if err == nil && !n.TestingFlag { //we wrote the config file
+        n.reload()//we need to get nginx to reload
+    }
+    return err
+}
 
-        if err == nil && !n.TestingFlag { //we wrote the config file
-            n.reload()//we need to get nginx to reload
+/*! \brief Returns the options with the template file read into TemplateText
+    This is what gets sent to subordinates, so they render the same template without needing the file themselves
+*/
+func (o Options_t) Inline () (Options_t, error) {
+    if len(o.Template) == 0 { return o, nil }
+    byt, err := ioutil.ReadFile(o.Template)
+    if err != nil {
+        return o, fmt.Errorf("Unable to read nginx template %s :: %s", o.Template, err.Error())
+    }
+    o.Template, o.TemplateText = "", string(byt)
+    return o, nil
+}
+
+/*! \brief Returns a list of everything that's wrong with the options, empty if they're good to go
+*/
+func (o Options_t) Validate () (errs []string) {
+    if len(o.Template) > 0 && len(o.TemplateText) > 0 {
+        errs = append(errs, "nginx template and template_text can't both be set")
+    }
+    if len(o.TemplateText) > 0 {
+        if _, err := template.New("upstream").Parse(o.TemplateText); err != nil {
+            errs = append(errs, fmt.Sprintf("nginx template_text doesn't parse :: %s", err.Error()))
+        }
+    }
+    if len(o.Template) > 0 {
+        if _, err := os.Stat(o.Template); err != nil {
+            errs = append(errs, fmt.Sprintf("nginx template %s can't be read :: %s", o.Template, err.Error()))
+        }
+    }
+    if o.MaxFails < 0 {
+        errs = append(errs, fmt.Sprintf("nginx max_fails can't be negative: %d", o.MaxFails))
+    }
+    for name, val := range map[string]string{ "fail_timeout": o.FailTimeout, "connect_timeout": o.ConnectTimeout, "proxy_timeout": o.ProxyTimeout, "resolver_valid": o.ResolverValid } {
+        if len(val) > 0 && !timeRegex.MatchString(val) {
+            errs = append(errs, fmt.Sprintf("nginx %s isn't a valid nginx time: %s", name, val))
         }
     }
-    return nil
+    sort.Strings(errs)  //map order is random, keep the report stable
+    return
 }
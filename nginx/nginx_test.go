@@ -0,0 +1,55 @@
+package nginx
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestRenderBuiltIn (t *testing.T) {
+    n := &Nginx_c{ Options: Options_t{ MaxFails: 2, ConnectTimeout: "1s" } }
+    content, err := n.Render("10.0.0.1", []int{ 6379, 6380 })
+    if err != nil { t.Fatal(err) }
+    for _, want := range []string{ "server 10.0.0.1:6379 max_fails=2;", "server 10.0.0.1:6380 max_fails=2;", "listen 6380;", "proxy_connect_timeout 1s;" } {
+        if !strings.Contains(content, want) { t.Fatalf("Missing %q in:\n%s", want, content) }
+    }
+    if strings.Contains(content, "resolver") { t.Fatalf("Resolver rendered without being set:\n%s", content) }
+}
+
+func TestRenderTemplate (t *testing.T) {
+    file := filepath.Join(t.TempDir(), "upstream.tmpl")
+    if err := ioutil.WriteFile(file, []byte("{{.IP}}:{{.Port}}\n"), 0644); err != nil { t.Fatal(err) }
+
+    n := &Nginx_c{ Options: Options_t{ Template: file } }
+    if content, err := n.Render("10.0.0.1", []int{ 6379 }); err != nil || content != "10.0.0.1:6379\n" { t.Fatalf("Template wasn't used: %q %v", content, err) }
+
+    //what a subordinate gets, it doesn't have the file
+    inline, err := n.Options.Inline()
+    if err != nil { t.Fatal(err) }
+    if len(inline.Template) > 0 || inline.TemplateText != "{{.IP}}:{{.Port}}\n" { t.Fatalf("Template wasn't inlined: %+v", inline) }
+    sub := &Nginx_c{ Options: inline }
+    if content, err := sub.Render("10.0.0.2", []int{ 6379 }); err != nil || content != "10.0.0.2:6379\n" { t.Fatalf("Inlined template wasn't used: %q %v", content, err) }
+}
+
+func TestRenderMissingTemplate (t *testing.T) {
+    n := &Nginx_c{ Options: Options_t{ Template: filepath.Join(t.TempDir(), "missing.tmpl") } }
+    content, err := n.Render("10.0.0.1", []int{ 6379 })
+    if err != nil { t.Fatal(err) }
+    if !strings.Contains(content, "server 10.0.0.1:6379;") { t.Fatalf("Didn't fall back to the built in template:\n%s", content) }
+}
+
+func TestSet (t *testing.T) {
+    n := &Nginx_c{ TestingFlag: true, Dir: t.TempDir() }
+    if err := n.Set("10.0.0.1", []int{ 6379 }); err != nil { t.Fatal(err) }
+    byt, err := ioutil.ReadFile(n.File())
+    if err != nil { t.Fatal(err) }
+    if !strings.Contains(string(byt), "server 10.0.0.1:6379;") { t.Fatalf("Wrong config written:\n%s", byt) }
+}
+
+func TestValidate (t *testing.T) {
+    if errs := (Options_t{ FailTimeout: "10 seconds", MaxFails: -1 }).Validate(); len(errs) != 2 { t.Fatalf("Expected 2 problems, got %v", errs) }
+    if errs := (Options_t{ Template: "a.tmpl", TemplateText: "{{.IP}}" }).Validate(); len(errs) < 1 { t.Fatal("Template and template_text were both accepted") }
+    if errs := (Options_t{ TemplateText: "{{.IP" }).Validate(); len(errs) != 1 { t.Fatalf("Bad template_text wasn't caught: %v", errs) }
+    if errs := (Options_t{ FailTimeout: "10s", ProxyTimeout: "5m" }).Validate(); len(errs) > 0 { t.Fatal(errs) }
+}
@@ -0,0 +1,37 @@
+/*! \file client.go
+  \brief The calls toggle makes against a redis server, as an interface so something other than a real server can answer them
+*/
+
+package redis
+
+import (
+	"time"
+)
+
+//everything toggle needs from a redis server
+type Client_i interface {
+    Health (mainFlag bool, profile Profile_t) Health_t
+    Subordinateof (ip, port string) error
+    PauseWrites (d time.Duration) error
+    Unpause () error
+    Role () (Role_t, error)
+    Offset () (int64, error)
+    Close ()
+}
+
+//opens a client to the server on this ip and port
+type Dialer_f func (ip string, port int, timeouts Timeouts_t) (Client_i, error)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns a dialer for real redis servers, keeping poolSize connections open to each
+*/
+func Dialer (poolSize int, testingFlag bool) Dialer_f {
+    return func (ip string, port int, timeouts Timeouts_t) (Client_i, error) {
+        r := &Redis_c{ TestingFlag: testingFlag, Timeouts: timeouts, PoolSize: poolSize }
+        if err := r.Connect(ip, port); err != nil { return nil, err }
+        return r, nil
+    }
+}
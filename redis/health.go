@@ -0,0 +1,245 @@
+/*! \file health.go
+  \brief Health checks against a redis server that go further than a ping
+
+  Profiles pick how deep a check goes
+    basic    - ping, and a set on the main, which is what we've always done
+    standard - basic, plus INFO checks and a write-then-read of a unique key on the main
+    strict   - standard, plus latency thresholds
+  Any of the fields can be set on top of a profile to change it.  A degraded server is still up, we alert on it but we
+  don't fail over because of it.
+*/
+
+package redis
+
+import (
+	"fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    StateHealthy    = "healthy"
+    StateDegraded   = "degraded"    //up, but something needs looking at
+    StateDown       = "down"
+)
+
+const (
+    ProfileBasic    = "basic"
+    ProfileStandard = "standard"
+    ProfileStrict   = "strict"
+)
+
+const defaultMemoryPercent = 90
+const defaultRoundTripTTL = 60
+
+var roundTripCount int64    //keeps the round trip keys unique within this process
+
+//how deep a health check goes
+type Profile_t struct {
+    Profile         string  `json:"profile,omitempty" yaml:"profile,omitempty" toml:"profile,omitempty"`    //basic, standard or strict, basic when empty
+    LatencyDegraded int     `json:"latency_degraded_ms,omitempty" yaml:"latency_degraded_ms,omitempty" toml:"latency_degraded_ms,omitzero"` //a ping slower than this is degraded
+    LatencyDown     int     `json:"latency_down_ms,omitempty" yaml:"latency_down_ms,omitempty" toml:"latency_down_ms,omitzero"`    //a ping slower than this counts as down
+    Info            bool    `json:"info,omitempty" yaml:"info,omitempty" toml:"info,omitempty"`                 //check INFO for loading, persistence, memory and rejected connections
+    MemoryPercent   int     `json:"memory_percent,omitempty" yaml:"memory_percent,omitempty" toml:"memory_percent,omitzero"` //used_memory over this percent of maxmemory is degraded
+    RoundTrip       bool    `json:"round_trip,omitempty" yaml:"round_trip,omitempty" toml:"round_trip,omitempty"`   //write a unique key to the main and read it back
+    RoundTripTTL    int     `json:"round_trip_ttl,omitempty" yaml:"round_trip_ttl,omitempty" toml:"round_trip_ttl,omitzero"`  //seconds, so the keys clean themselves up
+}
+
+//result of a health check
+type Health_t struct {
+    State       string
+    Latency     time.Duration   //how long the ping took
+    Reasons     []string        //why it's degraded or down
+    Rejected    int64           //rejected_connections from INFO, -1 when we didn't look
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (h *Health_t) degrade (format string, args ...interface{}) {
+    if h.State == StateHealthy { h.State = StateDegraded }
+    h.Reasons = append(h.Reasons, fmt.Sprintf(format, args...))
+}
+
+func (h *Health_t) down (format string, args ...interface{}) {
+    h.State = StateDown
+    h.Reasons = append(h.Reasons, fmt.Sprintf(format, args...))
+}
+
+/*! \brief Adds to how long the check took and holds it up against the profile's latency limits again
+    Used for injecting latency, so a slow check is treated the same as a slow ping
+*/
+func (h *Health_t) AddLatency (d time.Duration, profile Profile_t) {
+    if h.State == StateDown { return }
+    profile = profile.Resolve()
+    h.Latency += d
+
+    ms := int(h.Latency / time.Millisecond)
+    if profile.LatencyDown > 0 && ms >= profile.LatencyDown {
+        h.down("Ping took %s", h.Latency)
+    } else if profile.LatencyDegraded > 0 && ms >= profile.LatencyDegraded {
+        h.degrade("Ping took %s", h.Latency)
+    }
+}
+
+/*! \brief Looks through the INFO fields for anything that makes this server less than healthy
+*/
+func (r *Redis_c) checkInfo (profile Profile_t, h *Health_t) {
+    info, err := r.Info("")
+    if err != nil {
+        h.degrade("Unable to get INFO :: %s", err.Error())
+        return
+    }
+
+    if info["loading"] == "1" {
+        h.down("Still loading its dataset")
+    }
+    if info["rdb_bgsave_in_progress"] == "1" {
+        h.degrade("RDB save in progress")
+    }
+    if info["aof_rewrite_in_progress"] == "1" {
+        h.degrade("AOF rewrite in progress")
+    }
+
+    used, _ := strconv.ParseInt(info["used_memory"], 10, 64)
+    max, _ := strconv.ParseInt(info["maxmemory"], 10, 64)
+    if max > 0 && used * 100 >= max * int64(profile.MemoryPercent) {
+        h.degrade("Using %d%% of maxmemory", used * 100 / max)
+    }
+
+    if rejected, err := strconv.ParseInt(info["rejected_connections"], 10, 64); err == nil {
+        h.Rejected = rejected
+    }
+}
+
+/*! \brief Writes a key we've never used before and makes sure we get the same value back
+*/
+func (r *Redis_c) roundTrip (ttl int) error {
+    host, _ := os.Hostname()
+    key := fmt.Sprintf("toggle_toggle:%s:%d:%d", host, os.Getpid(), atomic.AddInt64(&roundTripCount, 1))
+    val := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+    if err := r.cachePool.Cmd("SET", key, val, "EX", ttl).Err; err != nil { return err }
+
+    got, err := r.Get(key)
+    if err != nil { return err }
+    if got != val {
+        return fmt.Errorf("Read back %q after writing %q to %s", got, val, key)
+    }
+    return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Fills in everything the named profile sets that wasn't set explicitly
+*/
+func (p Profile_t) Resolve () Profile_t {
+    switch p.Profile {
+    case ProfileStrict:
+        if p.LatencyDegraded == 0 { p.LatencyDegraded = 50 }
+        if p.LatencyDown == 0 { p.LatencyDown = 500 }
+        fallthrough
+    case ProfileStandard:
+        p.Info = true
+        p.RoundTrip = true
+    }
+    if p.MemoryPercent == 0 { p.MemoryPercent = defaultMemoryPercent }
+    if p.RoundTripTTL == 0 { p.RoundTripTTL = defaultRoundTripTTL }
+    return p
+}
+
+/*! \brief Returns anything wrong with the profile
+*/
+func (p Profile_t) Validate () (errs []string) {
+    switch p.Profile {
+    case "", ProfileBasic, ProfileStandard, ProfileStrict:
+    default:
+        errs = append(errs, fmt.Sprintf("health profile %q isn't one of basic, standard or strict", p.Profile))
+    }
+    if p.LatencyDegraded < 0 || p.LatencyDown < 0 || p.RoundTripTTL < 0 {
+        errs = append(errs, "health latencies and round_trip_ttl can't be negative")
+    }
+    if p.LatencyDegraded > 0 && p.LatencyDown > 0 && p.LatencyDegraded >= p.LatencyDown {
+        errs = append(errs, fmt.Sprintf("health latency_degraded_ms %d needs to be less than latency_down_ms %d", p.LatencyDegraded, p.LatencyDown))
+    }
+    if p.MemoryPercent < 0 || p.MemoryPercent > 100 {
+        errs = append(errs, fmt.Sprintf("health memory_percent %d needs to be between 1 and 100", p.MemoryPercent))
+    }
+    return
+}
+
+/*! \brief Returns the fields from INFO as a map, all the default sections when section is empty
+*/
+func (r *Redis_c) Info (section string) (map[string]string, error) {
+    args := []interface{}{}
+    if len(section) > 0 { args = append(args, section) }
+
+    info, err := r.cachePool.Cmd("INFO", args...).Str()
+    if err != nil { return nil, err }
+
+    ret := make(map[string]string)
+    for _, line := range strings.Split(info, "\n") {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 || line[0] == '#' { continue }    //blank or a section header
+        if idx := strings.Index(line, ":"); idx > 0 {
+            ret[line[:idx]] = line[idx+1:]
+        }
+    }
+    return ret, nil
+}
+
+/*! \brief Checks the server as deeply as the profile asks for
+    A main that's replicating from someone is degraded, one that can't be written to for any other reason is down
+*/
+func (r *Redis_c) Health (mainFlag bool, profile Profile_t) (h Health_t) {
+    profile = profile.Resolve()
+    h.State = StateHealthy
+    h.Rejected = -1
+
+    start := time.Now()
+    if !r.ping() {
+        h.down("Unable to 'ping' redis server")
+        return
+    }
+    h.Latency = time.Since(start)
+
+    ms := int(h.Latency / time.Millisecond)
+    if profile.LatencyDown > 0 && ms >= profile.LatencyDown {
+        h.down("Ping took %s", h.Latency)
+        return
+    }
+    if profile.LatencyDegraded > 0 && ms >= profile.LatencyDegraded {
+        h.degrade("Ping took %s", h.Latency)
+    }
+
+    if profile.Info {
+        r.checkInfo(profile, &h)
+        if h.State == StateDown { return }
+    }
+
+    if mainFlag {
+        var err error
+        if profile.RoundTrip {
+            err = r.roundTrip(profile.RoundTripTTL)
+        } else {
+            err = r.set("toggle_toggle", time.Now().Format("2006-01-02 15:04:05"))
+        }
+
+        if err != nil {
+            //a main that's replicating can't be written to, it's up to the caller to decide if it should be the main again
+            //since only they can see the other server, resetting it here is how both servers end up the main
+            if role, rerr := r.Role(); rerr == nil && !role.Main {
+                h.degrade("Replicating from %s:%d, so it can't be written to", role.MainHost, role.MainPort)
+            } else {
+                h.down("Unable to write :: %s", err.Error())
+            }
+        }
+    }
+    return
+}
@@ -5,16 +5,34 @@
 package redis
 
 import (
+    "errors"
 	"fmt"
+    "net"
+    "strconv"
+    "strings"
     "time"
 	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
 const maxRedisPoolSize = 10      //max number of cache threads waiting in the pool
 
+var ErrChanged = errors.New("Key was changed by someone else while we were setting it")
+
+//where a server sits in replication
+type Role_t struct {
+    Main        bool    //true if it's not replicating from anyone
+    MainHost    string  //who it's replicating from when it's not a main
+    MainPort    int
+    LinkUp      bool    //whether the replication link to its main is up
+    Offset      int64
+}
+
 type Redis_c struct {
 	cachePool *pool.Pool
     TestingFlag bool
+    Timeouts    Timeouts_t  //applied to every connection in the pool, so ping, set and Subordinateof can't hang
+    PoolSize    int         //connections the pool keeps, maxRedisPoolSize when not set
 }
 
 
@@ -40,7 +58,9 @@ func (r Redis_c) set (key, val string) error {
 //-------------------------------------------------------------------------------------------------------------------------//
 
 func (r *Redis_c) Connect (ip string, port int) (err error) {
-    r.cachePool, err = pool.New("tcp", fmt.Sprintf("%s:%d", ip, port), maxRedisPoolSize)
+    size := r.PoolSize
+    if size < 1 { size = maxRedisPoolSize }
+    r.cachePool, err = pool.NewCustom("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), size, r.Timeouts.dial)
     if err != nil {
         return fmt.Errorf("Cannont connect to redis server %s:%d :: %s", ip, port, err.Error())
     } else {
@@ -48,24 +68,14 @@ func (r *Redis_c) Connect (ip string, port int) (err error) {
     }
 }
 
-/*! \brief Sets up all the connection pools that we'll need in the future
+/*! \brief Basic health check, a ping and a set on the main.  See Health for deeper checks
 */
 func (r *Redis_c) Check(mainFlag bool) (error) {
-    //do a ping to make sure we got what we expected
-    if r.ping() {
-        if mainFlag {
-            //ping worked, now let's see if we can set things as we expect this to be the main
-            if err := r.set("toggle_toggle", time.Now().Format("2006-01-02 15:04:05")); err != nil {
-                //if ping works but set doesn't, assume we had a fail over and need to reset this as the main
-                fmt.Println("Main unable to be written to, resetting subordinate of no one")
-                return r.Subordinateof ("no", "one")  //return this if it errors
-            }
-        }
-
-        return nil  //we're good
-    } else {
-        return fmt.Errorf("Unable to 'ping' redis server")
+    h := r.Health(mainFlag, Profile_t{})
+    if h.State == StateDown {
+        return fmt.Errorf("%s", strings.Join(h.Reasons, ", "))
     }
+    return nil  //we're good
 }
 
 /*! \brief Tells the redis server who it should be a subordinate of
@@ -76,6 +86,103 @@ func (r *Redis_c) Subordinateof (ip, port string) (error) {
     return err
 }
 
+/*! \brief Pauses writes from clients for up to the duration passed in, redis lifts the pause itself if we never get to Unpause
+*/
+func (r *Redis_c) PauseWrites (d time.Duration) error {
+    if r.TestingFlag { return nil } //just testing
+    return r.cachePool.Cmd("CLIENT", "PAUSE", int64(d / time.Millisecond), "WRITE").Err
+}
+
+func (r *Redis_c) Unpause () error {
+    if r.TestingFlag { return nil } //just testing
+    return r.cachePool.Cmd("CLIENT", "UNPAUSE").Err
+}
+
+/*! \brief Returns the fields from INFO replication as a map
+*/
+func (r *Redis_c) Replication () (map[string]string, error) {
+    return r.Info("replication")
+}
+
+/*! \brief Returns what this server thinks its role in replication is
+*/
+func (r *Redis_c) Role () (ret Role_t, err error) {
+    info, err := r.Replication()
+    if err != nil { return }
+
+    switch info["role"] {
+    case "master":
+        ret.Main = true
+        ret.Offset, _ = strconv.ParseInt(info["master_repl_offset"], 10, 64)
+    case "slave":
+        ret.MainHost = info["master_host"]
+        ret.MainPort, _ = strconv.Atoi(info["master_port"])
+        ret.LinkUp = info["master_link_status"] == "up"
+        ret.Offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+    default:
+        err = fmt.Errorf("Unknown role %q", info["role"])
+    }
+    return
+}
+
+/*! \brief Returns the replication offset for this server
+    For a main that's how much it's sent, for a subordinate it's how much it's received from its main
+*/
+func (r *Redis_c) Offset () (int64, error) {
+    info, err := r.Replication()
+    if err != nil { return 0, err }
+
+    field := "master_repl_offset"
+    if info["role"] == "slave" {
+        if info["master_link_status"] != "up" {
+            return 0, fmt.Errorf("Subordinate isn't connected to its main")
+        }
+        field = "slave_repl_offset"
+    }
+    return strconv.ParseInt(info[field], 10, 64)
+}
+
+/*! \brief Returns the value of the key, empty if it isn't set
+*/
+func (r *Redis_c) Get (key string) (string, error) {
+    resp := r.cachePool.Cmd("GET", key)
+    if resp.IsType(redis.Nil) { return "", nil }
+    return resp.Str()
+}
+
+func (r *Redis_c) Set (key, val string) error {
+    return r.set(key, val)
+}
+
+/*! \brief Sets the key to val if check is happy with its current value and nobody changes it in between, using WATCH and MULTI
+    Returns ErrChanged if it was changed after we looked, or whatever check returned
+*/
+func (r *Redis_c) CompareAndSet (key string, check func (current string) error, val string) error {
+    c, err := r.cachePool.Get()    //WATCH only covers the connection it was sent on, so everything goes through this one
+    if err != nil { return err }
+    defer r.cachePool.Put(c)
+
+    if err = c.Cmd("WATCH", key).Err; err != nil { return err }
+    current := ""
+    if resp := c.Cmd("GET", key); !resp.IsType(redis.Nil) {
+        if current, err = resp.Str(); err != nil { return err }
+    }
+    if err = check(current); err != nil {
+        c.Cmd("UNWATCH")
+        return err
+    }
+
+    if err = c.Cmd("MULTI").Err; err != nil { return err }
+    if err = c.Cmd("SET", key, val).Err; err != nil {
+        c.Cmd("DISCARD")
+        return err
+    }
+    resp := c.Cmd("EXEC")
+    if resp.Err != nil { return resp.Err }
+    if resp.IsType(redis.Nil) { return ErrChanged } //the watched key changed, so redis dropped the transaction
+    return nil
+}
+
 func (r *Redis_c) Close () {
     r.cachePool.Empty()
 }
\ No newline at end of file
@@ -0,0 +1,213 @@
+/*! \file fake.go
+  \brief Pretend redis servers that live in memory, so the failover logic can be tested without running redis
+
+  A FakeNetwork_c hands out clients through its Dial, which matches redis.Dialer_f.  Every server starts out as a healthy
+  main, tests then take them down, make them read-only or change their roles and offsets.
+*/
+
+package redistest
+
+import (
+	"fmt"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+//one pretend redis server
+type FakeServer_c struct {
+    lock        sync.Mutex
+    down        bool    //nothing answers, including the dial
+    readOnly    bool    //writes fail even when it's the main
+    role        redis.Role_t
+    paused      bool
+    calls       []string    //every command that changes something, in order
+}
+
+//every pretend server, keyed by ip:port
+type FakeNetwork_c struct {
+    lock        sync.Mutex
+    servers     map[string]*FakeServer_c
+}
+
+type fakeClient_c struct {
+    s   *FakeServer_c
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (s *FakeServer_c) record (format string, args ...interface{}) {
+    s.calls = append(s.calls, fmt.Sprintf(format, args...))
+}
+
+func (s *FakeServer_c) unreachable () error {
+    return fmt.Errorf("dial tcp: connection refused")
+}
+
+//same as the unexported ones on redis.Health_t
+func degrade (h *redis.Health_t, format string, args ...interface{}) {
+    if h.State == redis.StateHealthy { h.State = redis.StateDegraded }
+    h.Reasons = append(h.Reasons, fmt.Sprintf(format, args...))
+}
+
+func down (h *redis.Health_t, format string, args ...interface{}) {
+    h.State = redis.StateDown
+    h.Reasons = append(h.Reasons, fmt.Sprintf(format, args...))
+}
+
+func (c *fakeClient_c) Health (mainFlag bool, profile redis.Profile_t) (h redis.Health_t) {
+    c.s.lock.Lock()
+    defer c.s.lock.Unlock()
+
+    h.State = redis.StateHealthy
+    h.Rejected = -1
+    if c.s.down {
+        down(&h, "Unable to 'ping' redis server")
+        return
+    }
+
+    if mainFlag && !c.s.role.Main {     //same as redis.Redis_c, a main that's replicating is only degraded
+        degrade(&h, "Replicating from %s:%d, so it can't be written to", c.s.role.MainHost, c.s.role.MainPort)
+    } else if mainFlag && c.s.readOnly {
+        down(&h, "Unable to write :: READONLY You can't write against a read only replica.")
+    }
+    return
+}
+
+func (c *fakeClient_c) Subordinateof (ip, port string) error {
+    c.s.lock.Lock()
+    defer c.s.lock.Unlock()
+    if c.s.down { return c.s.unreachable() }
+
+    c.s.record("SLAVEOF %s %s", ip, port)
+    if ip == "no" && port == "one" {
+        c.s.role = redis.Role_t{ Main: true, Offset: c.s.role.Offset }
+        return nil
+    }
+
+    p, err := strconv.Atoi(port)
+    if err != nil { return fmt.Errorf("ERR value is not an integer or out of range") }
+    c.s.role = redis.Role_t{ MainHost: ip, MainPort: p, LinkUp: true, Offset: c.s.role.Offset }
+    return nil
+}
+
+func (c *fakeClient_c) PauseWrites (d time.Duration) error {
+    c.s.lock.Lock()
+    defer c.s.lock.Unlock()
+    if c.s.down { return c.s.unreachable() }
+
+    c.s.record("CLIENT PAUSE %d WRITE", int64(d / time.Millisecond))
+    c.s.paused = true
+    return nil
+}
+
+func (c *fakeClient_c) Unpause () error {
+    c.s.lock.Lock()
+    defer c.s.lock.Unlock()
+    if c.s.down { return c.s.unreachable() }
+
+    c.s.record("CLIENT UNPAUSE")
+    c.s.paused = false
+    return nil
+}
+
+func (c *fakeClient_c) Role () (redis.Role_t, error) {
+    c.s.lock.Lock()
+    defer c.s.lock.Unlock()
+    if c.s.down { return redis.Role_t{}, c.s.unreachable() }
+    return c.s.role, nil
+}
+
+func (c *fakeClient_c) Offset () (int64, error) {
+    role, err := c.Role()
+    if err != nil { return 0, err }
+    if !role.Main && !role.LinkUp { return 0, fmt.Errorf("Subordinate isn't connected to its main") }
+    return role.Offset, nil
+}
+
+func (c *fakeClient_c) Close () {}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the server on this ip and port, making it as a healthy main if it's new
+*/
+func (n *FakeNetwork_c) Server (ip string, port int) *FakeServer_c {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    key := net.JoinHostPort(ip, strconv.Itoa(port))
+    if n.servers == nil { n.servers = make(map[string]*FakeServer_c) }
+    s, ok := n.servers[key]
+    if !ok {
+        s = &FakeServer_c{ role: redis.Role_t{ Main: true } }
+        n.servers[key] = s
+    }
+    return s
+}
+
+/*! \brief Connects to the pretend server, matches redis.Dialer_f
+*/
+func (n *FakeNetwork_c) Dial (ip string, port int, timeouts redis.Timeouts_t) (redis.Client_i, error) {
+    s := n.Server(ip, port)
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.down { return nil, fmt.Errorf("Cannont connect to redis server %s:%d :: %s", ip, port, s.unreachable().Error()) }
+    return &fakeClient_c{ s: s }, nil
+}
+
+/*! \brief Stops, or starts, the server answering anything
+*/
+func (s *FakeServer_c) SetDown (down bool) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.down = down
+}
+
+/*! \brief Makes writes fail even when the server's the main
+*/
+func (s *FakeServer_c) SetReadOnly (readOnly bool) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.readOnly = readOnly
+}
+
+func (s *FakeServer_c) SetOffset (offset int64) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.role.Offset = offset
+}
+
+/*! \brief Sets the role without it showing up in Calls, like someone changed it behind our back
+*/
+func (s *FakeServer_c) SetRole (role redis.Role_t) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.role = role
+}
+
+func (s *FakeServer_c) Role () redis.Role_t {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.role
+}
+
+func (s *FakeServer_c) Paused () bool {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.paused
+}
+
+/*! \brief Returns every command that changed something on the server, oldest first
+*/
+func (s *FakeServer_c) Calls () []string {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return append([]string{}, s.calls...)
+}
@@ -0,0 +1,73 @@
+/*! \file timeouts.go
+  \brief Dial, read and write timeouts on every connection we make, so a blackholed host can't hang a check
+*/
+
+package redis
+
+import (
+	"fmt"
+    "net"
+    "time"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const defaultTimeoutMs = 5000
+
+//how long we wait on a server before giving up, all in milliseconds, 5 seconds when not set
+type Timeouts_t struct {
+    DialMs      int     `json:"dial_ms,omitempty" yaml:"dial_ms,omitempty" toml:"dial_ms,omitzero"`
+    ReadMs      int     `json:"read_ms,omitempty" yaml:"read_ms,omitempty" toml:"read_ms,omitzero"`
+    WriteMs     int     `json:"write_ms,omitempty" yaml:"write_ms,omitempty" toml:"write_ms,omitzero"`
+}
+
+//sets a fresh deadline before every read and write, so each command gets the full timeout
+type deadlineConn struct {
+    net.Conn
+    read, write time.Duration
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (c *deadlineConn) Read (b []byte) (int, error) {
+    if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil { return 0, err }
+    return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write (b []byte) (int, error) {
+    if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil { return 0, err }
+    return c.Conn.Write(b)
+}
+
+func duration (ms int) time.Duration {
+    if ms < 1 { ms = defaultTimeoutMs }
+    return time.Duration(ms) * time.Millisecond
+}
+
+/*! \brief Dials the server the way the pool wants, with our timeouts on the connection
+*/
+func (t Timeouts_t) dial (network, addr string) (*redis.Client, error) {
+    conn, err := net.DialTimeout(network, addr, duration(t.DialMs))
+    if err != nil { return nil, err }
+
+    client, err := redis.NewClient(&deadlineConn{ Conn: conn, read: duration(t.ReadMs), write: duration(t.WriteMs) })
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return client, nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns anything wrong with the timeouts
+*/
+func (t Timeouts_t) Validate () (errs []string) {
+    if t.DialMs < 0 || t.ReadMs < 0 || t.WriteMs < 0 {
+        errs = append(errs, fmt.Sprintf("timeouts can't be negative: dial %d, read %d, write %d", t.DialMs, t.ReadMs, t.WriteMs))
+    }
+    return
+}
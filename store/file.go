@@ -0,0 +1,57 @@
+/*! \file file.go
+    \brief Keeps the state in a local json file
+*/
+
+package store
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type File_c struct {
+    Path    string
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (f *File_c) Load () (state State_t, err error) {
+    byt, err := ioutil.ReadFile(f.Path)
+    if os.IsNotExist(err) { return state, nil } //nothing saved yet
+    if err == nil {
+        err = json.Unmarshal(byt, &state)
+    }
+    return
+}
+
+/*! \brief Writes the state through a temp file and a rename so it's never left half written
+    The version check and the rename aren't atomic, so on a shared file this catches a stale save but not two at the same moment
+*/
+func (f *File_c) Save (state State_t) (int64, error) {
+    current, err := f.Load()
+    if err != nil { return 0, err }
+    if current.Version != state.Version { return 0, ErrStale }
+
+    state.Version++
+    byt, err := json.MarshalIndent(state, "", "    ")
+    if err != nil { return 0, err }
+
+    tmp, err := ioutil.TempFile(filepath.Dir(f.Path), "." + filepath.Base(f.Path) + ".tmp")
+    if err != nil { return 0, err }
+    defer os.Remove(tmp.Name())  //no-op once it's been renamed
+
+    _, err = tmp.Write(byt)
+    if err == nil { err = tmp.Sync() }
+    if cerr := tmp.Close(); err == nil { err = cerr }
+    if err == nil { err = os.Rename(tmp.Name(), f.Path) }
+    if err != nil { return 0, err }
+    return state.Version, nil
+}
@@ -0,0 +1,173 @@
+/*! \file kv.go
+    \brief Keeps the state in the key/value store of a Consul or etcd cluster, through their http apis
+
+    Neither keeps our version in the value, the state's version is Consul's ModifyIndex for the key or etcd's mod_revision,
+    and saves are a check-and-set on it, ?cas= for Consul and a txn for etcd
+*/
+
+package store
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type Consul_c struct {
+    Address     string  //http://host:8500
+    Key         string
+    Token       string  //ACL token, optional
+}
+
+type Etcd_c struct {
+    Address     string  //http://host:2379, uses the v3 json gateway
+    Key         string
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+var httpClient = &http.Client{ Timeout: time.Second * 5 }
+
+/*! \brief Makes the request and returns the body, a 404 comes back as a nil body and no error
+*/
+func request (req *http.Request) ([]byte, error) {
+    resp, err := httpClient.Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil { return nil, err }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    } else if resp.StatusCode > 299 {
+        return nil, fmt.Errorf("%s %s failed with code %d :: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+    return body, nil
+}
+
+func (c *Consul_c) url () string {
+    return fmt.Sprintf("%s/v1/kv/%s", strings.TrimRight(c.Address, "/"), strings.TrimLeft(c.Key, "/"))
+}
+
+func (c *Consul_c) do (method, query string, body []byte) ([]byte, error) {
+    req, err := http.NewRequest(method, c.url() + query, bytes.NewReader(body))
+    if err != nil { return nil, err }
+    if len(c.Token) > 0 { req.Header.Set("X-Consul-Token", c.Token) }
+    return request(req)
+}
+
+func (e *Etcd_c) do (path string, payload interface{}) ([]byte, error) {
+    byt, err := json.Marshal(payload)
+    if err != nil { return nil, err }
+
+    req, err := http.NewRequest("POST", strings.TrimRight(e.Address, "/") + path, bytes.NewReader(byt))
+    if err != nil { return nil, err }
+    req.Header.Set("Content-Type", "application/json")
+    return request(req)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the raw value and its ModifyIndex, a nil value if nothing's saved yet
+*/
+func (c *Consul_c) get () ([]byte, int64, error) {
+    body, err := c.do("GET", "", nil)
+    if err != nil || len(body) == 0 { return nil, 0, err }
+
+    var resp []struct {
+        ModifyIndex int64   `json:"ModifyIndex"`
+        Value       []byte  `json:"Value"`  //base64 in the json, which []byte decodes for us
+    }
+    if err = json.Unmarshal(body, &resp); err != nil || len(resp) == 0 { return nil, 0, err }
+    return resp[0].Value, resp[0].ModifyIndex, nil
+}
+
+func (c *Consul_c) Load () (state State_t, err error) {
+    value, index, err := c.get()
+    if err != nil || value == nil { return }
+
+    if err = json.Unmarshal(value, &state); err == nil {
+        state.Version = index
+    }
+    return
+}
+
+/*! \brief Saves the state with ?cas= so it only goes through if the key's ModifyIndex is still state.Version
+    Consul only answers true or false, so the new index comes from reading it back.  If what we read isn't what we wrote someone
+    saved in between, and their index isn't ours to use, so that's ErrStale too
+*/
+func (c *Consul_c) Save (state State_t) (int64, error) {
+    expected := state.Version
+    state.Version = 0   //not ours to keep, see above
+    byt, err := json.Marshal(state)
+    if err != nil { return 0, err }
+
+    body, err := c.do("PUT", fmt.Sprintf("?cas=%d", expected), byt)
+    if err != nil { return 0, err }
+    if strings.TrimSpace(string(body)) != "true" { return 0, ErrStale }
+
+    value, index, err := c.get()
+    if err != nil { return 0, err }
+    if !bytes.Equal(value, byt) { return 0, ErrStale }
+    return index, nil
+}
+
+func (e *Etcd_c) Load () (state State_t, err error) {
+    body, err := e.do("/v3/kv/range", map[string]string{ "key": base64.StdEncoding.EncodeToString([]byte(e.Key)) })
+    if err != nil || len(body) == 0 { return }
+
+    var resp struct {
+        Kvs []struct {
+            Value       string  `json:"value"`
+            ModRevision int64   `json:"mod_revision,string"`
+        } `json:"kvs"`
+    }
+    if err = json.Unmarshal(body, &resp); err != nil || len(resp.Kvs) == 0 { return }  //no kvs means nothing saved yet
+
+    byt, err := base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+    if err == nil {
+        err = json.Unmarshal(byt, &state)
+        state.Version = resp.Kvs[0].ModRevision
+    }
+    return
+}
+
+/*! \brief Saves the state in a txn that only puts it if the key's mod_revision is still state.Version, 0 if it doesn't exist yet
+*/
+func (e *Etcd_c) Save (state State_t) (int64, error) {
+    expected := state.Version
+    state.Version = 0   //not ours to keep, see above
+    byt, err := json.Marshal(state)
+    if err != nil { return 0, err }
+
+    key := base64.StdEncoding.EncodeToString([]byte(e.Key))
+    body, err := e.do("/v3/kv/txn", map[string]interface{}{
+        "compare": []map[string]string{ { "key": key, "target": "MOD", "result": "EQUAL", "mod_revision": fmt.Sprintf("%d", expected) } },
+        "success": []map[string]interface{}{ { "request_put": map[string]string{ "key": key, "value": base64.StdEncoding.EncodeToString(byt) } } },
+    })
+    if err != nil { return 0, err }
+
+    var resp struct {
+        Header struct {
+            Revision    int64   `json:"revision,string"`
+        } `json:"header"`
+        Succeeded   bool    `json:"succeeded"`    //left out when it's false
+    }
+    if err = json.Unmarshal(body, &resp); err != nil { return 0, err }
+    if !resp.Succeeded { return 0, ErrStale }
+    return resp.Header.Revision, nil    //our put is the last thing in this revision, so it's the key's mod_revision now
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "testing"
+)
+
+//stands in for one key in consul or etcd, with the index bumped on every write
+type fakeKV_t struct {
+    lock    sync.Mutex
+    value   []byte
+    index   int64   //0 while the key doesn't exist
+    next    int64
+    saved   func ()     //called after each write, so a test can get another one in before we look again
+}
+
+/*! \brief Writes the value if the index still matches, like both their check-and-sets do
+*/
+func (kv *fakeKV_t) cas (expected int64, value []byte) (int64, bool) {
+    kv.lock.Lock()
+    defer kv.lock.Unlock()
+    if expected != kv.index { return kv.next, false }
+    kv.next += 7    //other keys move the index too
+    kv.value, kv.index = value, kv.next
+    return kv.next, true
+}
+
+func newFakeConsul (t *testing.T, kv *fakeKV_t) *httptest.Server {
+    srv := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/v1/kv/" + DefaultKey { http.NotFound(w, r); return }
+
+        switch r.Method {
+        case "GET":
+            kv.lock.Lock()
+            defer kv.lock.Unlock()
+            if kv.index == 0 { http.NotFound(w, r); return }
+            json.NewEncoder(w).Encode([]map[string]interface{}{ { "ModifyIndex": kv.index, "Value": kv.value } })
+        case "PUT":
+            expected, err := strconv.ParseInt(r.URL.Query().Get("cas"), 10, 64)
+            if err != nil { t.Errorf("Save wasn't a check-and-set: %s", r.URL.RawQuery) }
+            body, _ := ioutil.ReadAll(r.Body)
+            _, ok := kv.cas(expected, body)
+            fmt.Fprint(w, ok)
+            if ok && kv.saved != nil { kv.saved() }
+        }
+    }))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func newFakeEtcd (t *testing.T) *httptest.Server {
+    kv := &fakeKV_t{}
+    srv := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/v3/kv/range":
+            kv.lock.Lock()
+            defer kv.lock.Unlock()
+            if kv.index == 0 { fmt.Fprint(w, `{}`); return }
+            json.NewEncoder(w).Encode(map[string]interface{}{ "kvs": []map[string]string{ { "value": string(kv.value), "mod_revision": strconv.FormatInt(kv.index, 10) } } })
+        case "/v3/kv/txn":
+            var req struct {
+                Compare []struct {
+                    Target      string  `json:"target"`
+                    ModRevision int64   `json:"mod_revision,string"`
+                } `json:"compare"`
+                Success []struct {
+                    RequestPut struct {
+                        Value   string  `json:"value"`
+                    } `json:"request_put"`
+                } `json:"success"`
+            }
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Compare) != 1 || req.Compare[0].Target != "MOD" || len(req.Success) != 1 {
+                t.Errorf("Save wasn't a txn on the mod_revision: %+v %v", req, err)
+                return
+            }
+            revision, ok := kv.cas(req.Compare[0].ModRevision, []byte(req.Success[0].RequestPut.Value))
+            resp := map[string]interface{}{ "header": map[string]string{ "revision": strconv.FormatInt(revision, 10) } }
+            if ok { resp["succeeded"] = true }  //etcd leaves it out when it's false
+            json.NewEncoder(w).Encode(resp)
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func TestConsul (t *testing.T) {
+    testCompareAndSwap(t, &Consul_c{ Address: newFakeConsul(t, &fakeKV_t{}).URL, Key: DefaultKey })
+}
+
+func TestConsulSavedOver (t *testing.T) {
+    kv := &fakeKV_t{}
+    c := &Consul_c{ Address: newFakeConsul(t, kv).URL, Key: DefaultKey }
+    kv.saved = func () {    //another host saves between our write and us reading the index back
+        kv.saved = nil
+        kv.cas(kv.index, []byte(`{"main":"10.0.0.2","subordinate":"10.0.0.1"}`))
+    }
+
+    if _, err := c.Save(State_t{ Main: "10.0.0.1", Subordinate: "10.0.0.2" }); err != ErrStale { t.Fatalf("Took someone else's index as ours :: %v", err) }
+    state, err := c.Load()
+    if err != nil || state.Main != "10.0.0.2" { t.Fatalf("Expected the other host's state: %+v %v", state, err) }
+}
+
+func TestEtcd (t *testing.T) {
+    testCompareAndSwap(t, &Etcd_c{ Address: newFakeEtcd(t).URL, Key: DefaultKey })
+}
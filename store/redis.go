@@ -0,0 +1,113 @@
+/*! \file redis.go
+    \brief Keeps the state in a key on a redis server, which shouldn't be one of the two we're toggling between
+*/
+
+package store
+
+import (
+    "encoding/json"
+    "net"
+    "strconv"
+    "sync"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type Redis_c struct {
+    Address     string  //host:port
+    Key         string
+    lock        sync.Mutex
+    client      *redis.Redis_c  //kept open between calls, nil until the first one or after something went wrong
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns our client, connecting it the first time, callers need to be holding s.lock
+*/
+func (s *Redis_c) connect () (*redis.Redis_c, error) {
+    if s.client != nil { return s.client, nil }
+
+    host, port, err := net.SplitHostPort(s.Address)
+    if err != nil { return nil, err }
+    p, err := strconv.Atoi(port)
+    if err != nil { return nil, err }
+
+    r := &redis.Redis_c{ PoolSize: 1 }  //we only ever make one call at a time
+    if err = r.Connect(host, p); err != nil { return nil, err }
+    s.client = r
+    return r, nil
+}
+
+/*! \brief Drops our client after an error, so the next call starts with a fresh connection, callers need to be holding s.lock
+*/
+func (s *Redis_c) reset () {
+    if s.client == nil { return }
+    s.client.Close()
+    s.client = nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (s *Redis_c) Load () (state State_t, err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    r, err := s.connect()
+    if err != nil { return }
+
+    val, err := r.Get(s.Key)
+    if err != nil {
+        s.reset()
+    } else if len(val) > 0 {
+        err = json.Unmarshal([]byte(val), &state)
+    }
+    return
+}
+
+/*! \brief Saves the state with WATCH and MULTI, so it only goes through if the key is still at state.Version
+*/
+func (s *Redis_c) Save (state State_t) (int64, error) {
+    expected := state.Version
+    state.Version++
+    byt, err := json.Marshal(state)
+    if err != nil { return 0, err }
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    r, err := s.connect()
+    if err != nil { return 0, err }
+
+    err = r.CompareAndSet(s.Key, func (val string) error {
+        var current State_t
+        if len(val) > 0 {
+            if err := json.Unmarshal([]byte(val), &current); err != nil { return err }
+        }
+        if current.Version != expected { return ErrStale }
+        return nil
+    }, string(byt))
+
+    if err == redis.ErrChanged {
+        return 0, ErrStale
+    } else if err != nil {
+        if err != ErrStale { s.reset() }
+        return 0, err
+    }
+    return state.Version, nil
+}
+
+/*! \brief Closes our connection, call this when the store is being replaced
+*/
+func (s *Redis_c) Close () {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.reset()
+}
@@ -0,0 +1,73 @@
+/*! \file store.go
+    \brief Keeps track of which server is the current main somewhere every toggle host can see it
+
+    The config file only knows what this host last did, so with more than one toggle host, or after a restart with a stale
+    config, we check the store to see who everyone agrees is the main.
+
+    Every save is a compare-and-swap against the version we last loaded, so when two toggle hosts both try to switch only the
+    first one's save goes through, the other gets ErrStale and leaves it to them.
+*/
+
+package store
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const DefaultKey = "redisToggle/state" //where we keep the state when the config doesn't say otherwise
+
+var ErrStale = errors.New("State was saved by someone else since it was loaded")
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//what we save, the public addresses of the two servers as they currently stand
+type State_t struct {
+    Main        string      `json:"main"`
+    Subordinate string      `json:"subordinate"`
+    Updated     time.Time   `json:"updated"`
+    Version     int64       `json:"version"`  //bumped on every save, consul and etcd use their own index instead, 0 when nothing's saved
+}
+
+type Store_i interface {
+    Load () (State_t, error)    //returns an empty State_t if nothing's been saved yet
+    Save (state State_t) (int64, error) //only if the store's still at state.Version, ErrStale if it isn't, returns the new version
+}
+
+//in memory stand in, nothing survives a restart so this is only really useful for tests
+type Memory_c struct {
+    lock    sync.Mutex
+    state   State_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns true if nothing has been saved yet
+*/
+func (s State_t) Empty () bool {
+    return len(s.Main) == 0
+}
+
+func (m *Memory_c) Load () (State_t, error) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    return m.state, nil
+}
+
+func (m *Memory_c) Save (state State_t) (int64, error) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    if state.Version != m.state.Version { return 0, ErrStale }
+    state.Version++
+    m.state = state
+    return state.Version, nil
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+//saves from a loaded state, a second save from the same one is stale
+func testCompareAndSwap (t *testing.T, s Store_i) {
+    t.Helper()
+    state, err := s.Load()
+    if err != nil || !state.Empty() { t.Fatalf("Expected nothing saved yet: %+v %v", state, err) }
+
+    state.Main, state.Subordinate = "10.0.0.1", "10.0.0.2"
+    version, err := s.Save(state)
+    if err != nil { t.Fatal(err) }
+
+    loaded, err := s.Load()
+    if err != nil || loaded.Main != "10.0.0.1" || loaded.Version != version { t.Fatalf("Didn't load what we saved: %+v %v", loaded, err) }
+
+    state.Main, state.Subordinate = "10.0.0.2", "10.0.0.1"
+    if _, err := s.Save(state); err != ErrStale { t.Fatalf("Save from a stale version returned %v", err) }
+    if loaded, _ = s.Load(); loaded.Main != "10.0.0.1" { t.Fatalf("Stale save overwrote the state: %+v", loaded) }
+
+    loaded.Main, loaded.Subordinate = "10.0.0.2", "10.0.0.1"
+    if _, err := s.Save(loaded); err != nil { t.Fatalf("Save from the current version failed :: %v", err) }
+}
+
+func TestMemory (t *testing.T) {
+    testCompareAndSwap(t, &Memory_c{})
+}
+
+func TestFile (t *testing.T) {
+    testCompareAndSwap(t, &File_c{ Path: filepath.Join(t.TempDir(), "state.json") })
+}
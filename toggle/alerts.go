@@ -0,0 +1,60 @@
+/*! \file alerts.go
+    \brief Raises alerts for things someone needs to look at, they go in the event log and to an optional webhook
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//what gets posted to the webhook
+type alert_t struct {
+    Host        string      `json:"host"`
+    Kind        string      `json:"kind"`
+    Message     string      `json:"message"`
+    Time        time.Time   `json:"time"`
+}
+
+type alerter_c struct {
+    Webhook     string      //url we post each alert to as json, nothing gets posted when empty
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Posts the alert to the webhook in the background, so a slow endpoint can't hold up a check
+*/
+func (a *alerter_c) Send (kind, message string) {
+    if len(a.Webhook) == 0 { return }
+
+    host, _ := os.Hostname()
+    byt, err := json.Marshal(alert_t{ Host: host, Kind: kind, Message: message, Time: time.Now() })
+    if err != nil {
+        log.Println(err)
+        return
+    }
+
+    go func (url string) {
+        client := &http.Client{ Timeout: time.Second * 10 }
+        resp, err := client.Post(url, "application/json", bytes.NewReader(byt))
+        if err != nil {
+            log.Printf("Unable to send alert to %s :: %s\n", url, err.Error())
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode > 299 {
+            log.Printf("Alert webhook %s returned %d\n", url, resp.StatusCode)
+        }
+    }(a.Webhook)
+}
@@ -0,0 +1,224 @@
+/*! \file api.go
+    \brief Admin http endpoints for manually switching, pausing failover, reloading the config and getting the current status and history
+    and, when it's enabled, injecting faults for failover drills
+*/
+
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type api_c struct {
+    Tasks       *tasks_c
+    Token       string  //bearer token required for every admin call, the admin api is disabled when this is empty
+    ConfigFile  string
+    Graceful    time.Duration   //how long a graceful switch gets before it's aborted
+    Chaos       bool    //allows faults to be injected through /chaos, only for drills
+}
+
+type apiResponse_t struct {
+    Message     string      `json:"message"`
+    Switched    bool        `json:"switched,omitempty"`
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func writeJSON (w http.ResponseWriter, code int, val interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    if err := json.NewEncoder(w).Encode(val); err != nil {
+        log.Println(err)
+    }
+}
+
+/*! \brief Returns true if the request has our token
+*/
+func (a *api_c) authorized (r *http.Request) bool {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return len(a.Token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+/*! \brief Wraps a handler so it's only called with the right method and a valid token
+*/
+func (a *api_c) admin (method string, handler http.HandlerFunc) http.HandlerFunc {
+    return func (w http.ResponseWriter, r *http.Request) {
+        if len(a.Token) == 0 {
+            writeJSON(w, http.StatusForbidden, apiResponse_t{ Message: "Admin api is disabled, start toggle with -token= to enable it" })
+            return
+        }
+
+        if !a.authorized(r) {
+            writeJSON(w, http.StatusUnauthorized, apiResponse_t{ Message: "Invalid token" })
+            return
+        }
+
+        if r.Method != method {
+            w.Header().Set("Allow", method)
+            writeJSON(w, http.StatusMethodNotAllowed, apiResponse_t{ Message: "Method not allowed" })
+            return
+        }
+        handler(w, r)
+    }
+}
+
+/*! \brief POST /switch with an optional ?target=ip of the server that should end up as the main
+    This is a graceful switch unless ?force=true is passed, which does the same thing we do when the main is down
+*/
+func (a *api_c) switchEndpoint (w http.ResponseWriter, r *http.Request) {
+    if target := r.URL.Query().Get("target"); len(target) > 0 {
+        config := a.Tasks.CurrentConfig()
+        switch target {
+        case config.Main.PublicIP, config.Main.PrivateIP:
+            writeJSON(w, http.StatusOK, apiResponse_t{ Message: target + " is already the main" })
+            return
+        case config.Subordinate.PublicIP, config.Subordinate.PrivateIP:
+            //this is who we're switching to anyway
+        default:
+            writeJSON(w, http.StatusBadRequest, apiResponse_t{ Message: "Target " + target + " isn't one of our servers" })
+            return
+        }
+    }
+
+    var started, switched bool
+    if r.URL.Query().Get("force") == "true" {  //treat it like the main is down
+        log.Println("Forced switch due to admin request")
+        started, switched = a.Tasks.TrySwitch()
+    } else {
+        log.Println("Graceful switch due to admin request")
+        var err error
+        started, err = a.Tasks.TryGracefulSwitch(a.Graceful)
+        if started && err != nil {
+            writeJSON(w, http.StatusInternalServerError, apiResponse_t{ Message: "Graceful switch aborted :: " + err.Error() })
+            return
+        }
+        switched = started
+    }
+
+    if !started {
+        writeJSON(w, http.StatusConflict, apiResponse_t{ Message: "Another check or switch is in progress, try again" })
+    } else if !switched {
+        writeJSON(w, http.StatusInternalServerError, apiResponse_t{ Message: "Unable to promote the subordinate to main" })
+    } else {
+        a.Tasks.WriteConfig(a.ConfigFile)
+        config := a.Tasks.CurrentConfig()
+        writeJSON(w, http.StatusOK, apiResponse_t{ Message: "Switched to new main at " + config.Main.PublicIP, Switched: true })
+    }
+}
+
+func (a *api_c) pauseEndpoint (w http.ResponseWriter, r *http.Request) {
+    a.Tasks.Pause(true)
+    writeJSON(w, http.StatusOK, apiResponse_t{ Message: "Automatic failover paused" })
+}
+
+func (a *api_c) resumeEndpoint (w http.ResponseWriter, r *http.Request) {
+    a.Tasks.Pause(false)
+    writeJSON(w, http.StatusOK, apiResponse_t{ Message: "Automatic failover resumed" })
+}
+
+func (a *api_c) reloadEndpoint (w http.ResponseWriter, r *http.Request) {
+    if err := reloadConfig(a.Tasks, a.ConfigFile); err != nil {
+        writeJSON(w, http.StatusBadRequest, apiResponse_t{ Message: err.Error() })
+        return
+    }
+    writeJSON(w, http.StatusOK, apiResponse_t{ Message: "Config reloaded" })
+}
+
+/*! \brief POST /chaos?fault=fail|latency|switch|clear injects a fault, see chaos.go
+    &duration= how long it lasts, or the window for a switch, &delay= before it starts, &latency= in ms, durations are like 30s or 5m
+*/
+func (a *api_c) chaosEndpoint (w http.ResponseWriter, r *http.Request) {
+    if !a.Chaos {
+        writeJSON(w, http.StatusForbidden, apiResponse_t{ Message: "Chaos is disabled, start toggle with -chaos to enable it" })
+        return
+    }
+
+    query := r.URL.Query()
+    if query.Get("fault") == "clear" {
+        count := a.Tasks.ClearFaults()
+        writeJSON(w, http.StatusOK, apiResponse_t{ Message: fmt.Sprintf("Cleared %d faults", count) })
+        return
+    }
+
+    var delay, duration time.Duration
+    var latency int
+    var err error
+    if len(query.Get("delay")) > 0 {
+        delay, err = time.ParseDuration(query.Get("delay"))
+    }
+    if err == nil {
+        duration, err = time.ParseDuration(query.Get("duration"))
+    }
+    if err == nil && len(query.Get("latency")) > 0 {
+        latency, err = strconv.Atoi(query.Get("latency"))
+    }
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, apiResponse_t{ Message: err.Error() })
+        return
+    }
+
+    f, err := a.Tasks.Inject(query.Get("fault"), delay, duration, latency)
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, apiResponse_t{ Message: err.Error() })
+        return
+    }
+    log.Printf("Chaos due to admin request, scheduled %s", f)
+    writeJSON(w, http.StatusOK, apiResponse_t{ Message: "Scheduled " + f.String() })
+}
+
+/*! \brief GET / returns what subordinates need, our servers, ports and nginx settings, plus the health checks for when
+    they're running on their own.  The state backend is only included for callers with our token, nothing else in the config is
+*/
+func (a *api_c) mainEndpoint (w http.ResponseWriter, r *http.Request) {
+    if r.Method == "OPTIONS" { return } //this is a "test" request sent by javascript to test if the call is valid, or something, so just ignore it
+
+    config := a.Tasks.CurrentConfig()
+    ret := appConfig_t{ Main: config.Main, Subordinate: config.Subordinate, Ports: config.Ports, DNS: dns_t{ TTL: config.DNS.TTL },
+        Health: config.Health, Detection: config.Detection }
+    if a.authorized(r) { ret.State = config.State }
+
+    var err error
+    if ret.Nginx, err = config.Nginx.Inline(); err != nil {  //subordinates won't have the template file
+        writeJSON(w, http.StatusInternalServerError, apiResponse_t{ Message: err.Error() })
+        return
+    }
+    writeJSON(w, http.StatusOK, ret)
+}
+
+func (a *api_c) statusEndpoint (w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, a.Tasks.Status())
+}
+
+func (a *api_c) historyEndpoint (w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, a.Tasks.History())
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Adds the admin endpoints, and the one subordinates poll, to the mux passed in
+*/
+func (a *api_c) Register (mux *http.ServeMux) {
+    mux.HandleFunc("/", a.mainEndpoint)
+    mux.HandleFunc("/switch", a.admin("POST", a.switchEndpoint))
+    mux.HandleFunc("/pause", a.admin("POST", a.pauseEndpoint))
+    mux.HandleFunc("/resume", a.admin("POST", a.resumeEndpoint))
+    mux.HandleFunc("/reload", a.admin("POST", a.reloadEndpoint))
+    mux.HandleFunc("/chaos", a.admin("POST", a.chaosEndpoint))
+    mux.HandleFunc("/status", a.admin("GET", a.statusEndpoint))
+    mux.HandleFunc("/history", a.admin("GET", a.historyEndpoint))
+}
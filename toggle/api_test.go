@@ -0,0 +1,52 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+//sends the request through the api's mux, with the token when there is one
+func apiRequest (a *api_c, method, path, token string) *httptest.ResponseRecorder {
+    mux := http.NewServeMux()
+    a.Register(mux)
+    req := httptest.NewRequest(method, path, nil)
+    if len(token) > 0 { req.Header.Set("Authorization", "Bearer " + token) }
+    w := httptest.NewRecorder()
+    mux.ServeHTTP(w, req)
+    return w
+}
+
+func TestAPIToken (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+
+    if w := apiRequest(&api_c{ Tasks: tasks }, "GET", "/status", ""); w.Code != http.StatusForbidden { t.Fatalf("Admin api answered %d without a token set", w.Code) }
+
+    a := &api_c{ Tasks: tasks, Token: "secret" }
+    for token, want := range map[string]int{ "": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK } {
+        if w := apiRequest(a, "GET", "/status", token); w.Code != want { t.Fatalf("Token %q got %d, wanted %d", token, w.Code, want) }
+    }
+    if w := apiRequest(a, "GET", "/pause", "secret"); w.Code != http.StatusMethodNotAllowed { t.Fatalf("GET /pause got %d", w.Code) }
+    if tasks.status.Paused() { t.Fatal("Paused with the wrong method") }
+    if w := apiRequest(a, "POST", "/pause", "wrong"); w.Code != http.StatusUnauthorized || tasks.status.Paused() { t.Fatalf("Paused with the wrong token, got %d", w.Code) }
+    if w := apiRequest(a, "POST", "/pause", "secret"); w.Code != http.StatusOK || !tasks.status.Paused() { t.Fatalf("Not paused with the right token, got %d", w.Code) }
+}
+
+func TestAPISubordinateConfig (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+    tasks.Config.Alerts.Webhook = "https://hooks.example.com/secret"
+    tasks.Config.State = state_t{ Backend: "redis", Address: "10.0.0.9:6379", Key: "toggle" }
+    a := &api_c{ Tasks: tasks, Token: "secret" }
+
+    for token, withState := range map[string]bool{ "": false, "wrong": false, "secret": true } {
+        w := apiRequest(a, "GET", "/", token)
+        if w.Code != http.StatusOK { t.Fatalf("GET / got %d", w.Code) }
+
+        var config appConfig_t
+        if err := json.NewDecoder(w.Body).Decode(&config); err != nil { t.Fatal(err) }
+        if config.Main.PublicIP != testMain || len(config.Ports) != 1 { t.Fatalf("Missing the servers or ports: %+v", config) }
+        if len(config.Alerts.Webhook) > 0 { t.Fatal("Alert webhook was handed out") }
+        if got := len(config.State.Address) > 0; got != withState { t.Fatalf("Token %q got the state backend %v", token, got) }
+    }
+}
@@ -0,0 +1,204 @@
+/*! \file chaos.go
+    \brief Fault injection for failover drills, so we can rehearse a failover without killing redis
+
+    Faults are injected through the admin api, which only allows it when toggle was started with -chaos
+        fail    - checks against the current main fail for the duration, which will fail over for real
+        latency - every check is slowed down by this many ms for the duration
+        switch  - switches at a random time within the window, the same way we do when the main goes down
+    Any of them can be delayed to start later.  Everything shows up in the event log.
+*/
+
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    faultFail       = "fail"
+    faultLatency    = "latency"
+    faultSwitch     = "switch"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type fault_t struct {
+    Kind        string      `json:"kind"`
+    Target      string      `json:"target,omitempty"`      //the server that fails, for fail
+    LatencyMs   int         `json:"latency_ms,omitempty"`  //for latency
+    Start       time.Time   `json:"start"`
+    End         time.Time   `json:"end"`                   //for switch this is when it happens
+    started     bool        //so we only report the start once
+}
+
+type chaos_c struct {
+    lock        sync.Mutex
+    faults      []fault_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (f fault_t) String () string {
+    switch f.Kind {
+    case faultFail:
+        return fmt.Sprintf("simulated failure of %s from %s to %s", f.Target, f.Start.Format("15:04:05"), f.End.Format("15:04:05"))
+    case faultLatency:
+        return fmt.Sprintf("%dms of latency from %s to %s", f.LatencyMs, f.Start.Format("15:04:05"), f.End.Format("15:04:05"))
+    }
+    return fmt.Sprintf("forced switch at %s", f.End.Format("15:04:05"))
+}
+
+/*! \brief Returns true if checks against this host should fail right now
+*/
+func (c *chaos_c) failing (host string, now time.Time) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for _, f := range c.faults {
+        if f.Kind == faultFail && f.Target == host && !now.Before(f.Start) && now.Before(f.End) { return true }
+    }
+    return false
+}
+
+/*! \brief Returns how much latency to add to a check right now
+*/
+func (c *chaos_c) latency (now time.Time) (ret time.Duration) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for _, f := range c.faults {
+        if f.Kind == faultLatency && !now.Before(f.Start) && now.Before(f.End) {
+            ret += time.Duration(f.LatencyMs) * time.Millisecond
+        }
+    }
+    return
+}
+
+/*! \brief Moves the faults along, returning the ones that just started and just finished
+    A switch that's due counts as finished, it's up to the caller to do it
+*/
+func (c *chaos_c) tick (now time.Time) (started, finished []fault_t) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    keep := c.faults[:0]
+    for _, f := range c.faults {
+        if !f.started && f.Kind != faultSwitch && !now.Before(f.Start) {
+            f.started = true
+            started = append(started, f)
+        }
+        if now.Before(f.End) {
+            keep = append(keep, f)
+        } else {
+            finished = append(finished, f)
+        }
+    }
+    c.faults = keep
+    return
+}
+
+/*! \brief Reports and finishes any faults that are due, callers need to be holding t.lock
+    Returns true if a forced switch happened
+*/
+func (t *tasks_c) chaosTick () (switched bool) {
+    started, finished := t.chaos.tick(time.Now())
+    for _, f := range started {
+        t.events.Add("chaos", "Started " + f.String())
+    }
+    for _, f := range finished {
+        if f.Kind != faultSwitch {
+            t.events.Add("chaos", "Finished " + f.String())
+            continue
+        }
+        if t.status.Paused() {
+            t.events.Add("chaos", "Skipped " + f.String() + ", automatic failover is paused")
+            continue
+        }
+        if reason := t.damped(time.Now()); len(reason) > 0 {
+            t.events.Add("chaos", "Skipped " + f.String() + " :: " + reason)
+            continue
+        }
+        from := t.Config.Main.PublicIP
+        t.events.Add("chaos", fmt.Sprintf("Forcing a switch away from %s", from))
+        if t.switchServers() {
+            t.failedFrom = from     //same as a real failover, so failback and damping can be rehearsed too
+            t.recordSwitch(time.Now())
+            switched = true
+        }
+    }
+    return
+}
+
+/*! \brief Applies any injected faults to a check against this host
+    Returns false if the check should fail without running, otherwise how long we held it up for
+*/
+func (t *tasks_c) chaosCheck (host string) (bool, time.Duration) {
+    now := time.Now()
+    if t.chaos.failing(host, now) { return false, 0 }
+
+    delay := t.chaos.latency(now)
+    if delay > 0 { time.Sleep(delay) }
+    return true, delay
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Injects a fault that starts after delay
+    duration is how long a fail or latency fault lasts, for a switch it's the window we pick a random time in
+*/
+func (t *tasks_c) Inject (kind string, delay, duration time.Duration, latencyMs int) (f fault_t, err error) {
+    if delay < 0 || duration <= 0 { return f, fmt.Errorf("Needs a duration, and the delay can't be negative") }
+
+    f = fault_t{ Kind: kind, Start: time.Now().Add(delay) }
+    f.End = f.Start.Add(duration)
+    switch kind {
+    case faultFail:
+        f.Target = t.CurrentConfig().Main.PublicIP
+    case faultLatency:
+        if latencyMs < 1 { return f, fmt.Errorf("Latency needs to be at least 1ms") }
+        f.LatencyMs = latencyMs
+    case faultSwitch:
+        f.Start = f.Start.Add(time.Duration(rand.Int63n(int64(duration))))
+        f.End = f.Start
+    default:
+        return f, fmt.Errorf("Unknown fault %q, needs to be fail, latency or switch", kind)
+    }
+
+    t.chaos.lock.Lock()
+    t.chaos.faults = append(t.chaos.faults, f)
+    t.chaos.lock.Unlock()
+
+    t.events.Add("chaos", "Scheduled " + f.String())
+    return f, nil
+}
+
+/*! \brief Removes every fault, returns how many there were
+*/
+func (t *tasks_c) ClearFaults () int {
+    t.chaos.lock.Lock()
+    count := len(t.chaos.faults)
+    t.chaos.faults = nil
+    t.chaos.lock.Unlock()
+
+    t.events.Add("chaos", fmt.Sprintf("Cleared %d faults", count))
+    return count
+}
+
+/*! \brief Returns the faults that are running or waiting to
+*/
+func (t *tasks_c) Faults () []fault_t {
+    t.chaos.lock.Lock()
+    defer t.chaos.lock.Unlock()
+    return append([]fault_t{}, t.chaos.faults...)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestChaosFail (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    if _, err := tasks.Inject(faultFail, 0, time.Minute, 0); err != nil { t.Fatal(err) }
+
+    if !tasks.Check() { t.Fatal("Check didn't switch with a simulated failure of the main") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Config wasn't swapped: main %s", tasks.Config.Main.PublicIP) }
+    if !hasEvent(tasks, "chaos") || !hasEvent(tasks, "failover") { t.Fatalf("Missing chaos events: %+v", tasks.History()) }
+    waitForRole(t, network.Server(testMain, 6379), testSub, 6379)  //it's still reachable, only the checks failed
+
+    if tasks.ClearFaults() != 1 || len(tasks.Faults()) != 0 { t.Fatal("Fault wasn't cleared") }
+}
+
+func TestChaosSwitch (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+    if _, err := tasks.Inject(faultSwitch, 0, time.Millisecond, 0); err != nil { t.Fatal(err) }
+    time.Sleep(time.Millisecond * 5)
+
+    if !tasks.Check() { t.Fatal("Check didn't force a switch") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Config wasn't swapped: main %s", tasks.Config.Main.PublicIP) }
+    if len(tasks.Faults()) != 0 { t.Fatal("Switch fault wasn't finished") }
+
+    if _, err := tasks.Inject("flood", 0, time.Minute, 0); err == nil { t.Fatal("Unknown fault was accepted") }
+}
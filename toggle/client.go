@@ -0,0 +1,243 @@
+/*! \file client.go
+    \brief Command line subcommands that talk to a running toggle's admin api
+
+    toggle status|switch|pause|resume|reload|history [-addr=host:port] [-token=] [-json]
+    toggle switch [-target=ip] [-force]
+    toggle chaos -fault=fail|latency|switch|clear [-duration=30s] [-delay=0s] [-latency=ms]
+    toggle validate-config [-c=toggle.conf]
+    toggle plan [-c=toggle.conf] [-graceful=seconds] [-nginx-dir=] [-json]
+*/
+
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type client_c struct {
+    Addr        string
+    Token       string
+    JSON        bool    //print the raw json instead of the human readable version
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Makes a request against the admin api and returns the body, non 2xx responses come back as an error
+*/
+func (c *client_c) request (method, path string) ([]byte, error) {
+    addr := c.Addr
+    if !strings.HasPrefix(addr, "http") { addr = "http://" + addr }
+
+    req, err := http.NewRequest(method, addr + path, nil)
+    if err != nil { return nil, err }
+    req.Header.Set("Accept", "application/json")
+    req.Header.Set("Authorization", "Bearer " + c.Token)
+
+    client := &http.Client{ Timeout: time.Minute }  //switches can take a bit
+    resp, err := client.Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil { return nil, err }
+
+    if resp.StatusCode > 299 {
+        var msg apiResponse_t
+        if json.Unmarshal(body, &msg) == nil && len(msg.Message) > 0 {
+            return body, fmt.Errorf("%s (%d)", msg.Message, resp.StatusCode)
+        }
+        return body, fmt.Errorf("Request failed with code %d", resp.StatusCode)
+    }
+    return body, nil
+}
+
+func (c *client_c) printStatus (body []byte) error {
+    var status status_t
+    if err := json.Unmarshal(body, &status); err != nil { return err }
+
+    fmt.Printf("Version:     %s\n", status.Version)
+    fmt.Printf("Main:        %s\n", status.Main)
+    fmt.Printf("Subordinate: %s\n", status.Subordinate)
+    fmt.Printf("Paused:      %t\n", status.Paused)
+    if status.Operation != nil {
+        fmt.Printf("In progress: %s since %s\n", status.Operation.Name, status.Operation.Started.Format("2006-01-02 15:04:05"))
+    }
+    cs := status.Connections
+    fmt.Printf("Connections: %d open, %d opened, %d failed, %d dropped, %d reused\n", cs.Open, cs.Connects, cs.Failures, cs.Drops, cs.Reuses)
+    for _, f := range status.Faults {
+        fmt.Printf("Chaos:       %s\n", f)
+    }
+    for _, d := range status.Demotions {
+        fmt.Printf("Demoting:    %s:%d to %s, %d attempts, next at %s :: %s\n", d.Host, d.Port, d.NewMain, d.Attempts, d.NextTry.Format("15:04:05"), d.LastError)
+    }
+    fmt.Println()
+
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "PORT\tSERVER\tROLE\tSTATE\tLAST CHECK\tERROR")
+    for _, p := range status.Ports {
+        for _, n := range p.Nodes {
+            last := "never"
+            if !n.LastCheck.IsZero() { last = n.LastCheck.Format("2006-01-02 15:04:05") }
+            state := n.State
+            if len(state) == 0 { state = "unknown" }
+            fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", p.Port, n.IP, n.Role, state, last, n.Error)
+        }
+    }
+    return tw.Flush()
+}
+
+func (c *client_c) printHistory (body []byte) error {
+    var events []event_t
+    if err := json.Unmarshal(body, &events); err != nil { return err }
+
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "TIME\tKIND\tMESSAGE")
+    for _, e := range events {
+        fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Time.Format("2006-01-02 15:04:05"), e.Kind, e.Message)
+    }
+    return tw.Flush()
+}
+
+func (c *client_c) printMessage (body []byte) error {
+    var msg apiResponse_t
+    if err := json.Unmarshal(body, &msg); err != nil { return err }
+    fmt.Println(msg.Message)
+    return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Simulates a switch from the current config and prints everything it would do, without changing anything
+*/
+func runPlan (flags *flag.FlagSet, args []string) {
+    configFlag := flags.String("c", "toggle.conf", "Location of the config file")
+    gracefulFlag := flags.Int("graceful", 0, "Plan a graceful switch with this many seconds to sync, instead of a failover from a dead main")
+    nginxDirFlag := flags.String("nginx-dir", "", "Directory nginx keeps its config in, defaults to /etc/nginx")
+    jsonFlag := flags.Bool("json", false, "Print the plan as json")
+    flags.Parse(args)
+
+    var config appConfig_t
+    if err := loadConfig(&config, *configFlag); err != nil { log.Fatalln(err) }
+
+    from, to := config.Main.PublicIP, config.Subordinate.PublicIP
+    tasks := tasks_c{ Config: &config, Store: newStore(config.State), NginxDir: *nginxDirFlag, Plan: &plan_c{} }
+    tasks.nginx.Dir = *nginxDirFlag
+    tasks.applySettings()
+    defer tasks.Close()
+
+    log.SetOutput(ioutil.Discard)   //the events would get mixed in with the plan
+    switched := false
+    if *gracefulFlag > 0 {
+        err := tasks.GracefulSwitch(time.Second * time.Duration(*gracefulFlag))
+        if err != nil { fmt.Fprintf(os.Stderr, "Graceful switch would fail :: %s\n", err.Error()) }
+        switched = err == nil
+    } else {
+        switched = tasks.Switch()
+    }
+    if switched { tasks.WriteConfig(*configFlag) }
+    log.SetOutput(os.Stderr)
+
+    actions := tasks.Plan.Reset()
+    if *jsonFlag {
+        byt, _ := json.MarshalIndent(actions, "", "    ")
+        fmt.Println(string(byt))
+    } else {
+        fmt.Printf("Switching from %s to %s would:\n", from, to)
+        printPlan(os.Stdout, actions)
+    }
+    if !switched { os.Exit(1) }
+}
+
+/*! \brief Runs the subcommand passed in, returns false if it's not one of ours so main can carry on as normal
+*/
+func runCommand (args []string) bool {
+    if len(args) < 1 { return false }
+
+    type command_t struct {
+        method, path    string
+        print           func (*client_c, []byte) error
+    }
+    commands := map[string]command_t {
+        "status":   { "GET", "/status", (*client_c).printStatus },
+        "history":  { "GET", "/history", (*client_c).printHistory },
+        "switch":   { "POST", "/switch", (*client_c).printMessage },
+        "pause":    { "POST", "/pause", (*client_c).printMessage },
+        "resume":   { "POST", "/resume", (*client_c).printMessage },
+        "reload":   { "POST", "/reload", (*client_c).printMessage },
+        "chaos":    { "POST", "/chaos", (*client_c).printMessage },
+    }
+
+    name := args[0]
+    flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+    if name == "validate-config" {
+        configFlag := flags.String("c", "toggle.conf", "Location of the config file")
+        flags.Parse(args[1:])
+
+        var config appConfig_t
+        if err := loadConfig(&config, *configFlag); err != nil { log.Fatalln(err) }
+        fmt.Printf("%s is valid: main %s, subordinate %s, ports %v\n", *configFlag, config.Main.PublicIP, config.Subordinate.PublicIP, config.Ports)
+        return true
+    }
+
+    if name == "plan" {
+        runPlan(flags, args[1:])
+        return true
+    }
+
+    cmd, ok := commands[name]
+    if !ok { return false }
+
+    c := client_c{}
+    flags.StringVar(&c.Addr, "addr", os.Getenv("TOGGLE_ADDR"), "host:port of the running toggle's admin api, defaults to $TOGGLE_ADDR")
+    flags.StringVar(&c.Token, "token", os.Getenv("TOGGLE_TOKEN"), "Admin api token, defaults to $TOGGLE_TOKEN")
+    flags.BoolVar(&c.JSON, "json", false, "Print the json response instead of a human readable version")
+    target := flags.String("target", "", "For switch, the ip of the server that should end up as the main")
+    force := flags.Bool("force", false, "For switch, skip waiting for the subordinate to catch up, same as when the main is down")
+    fault := flags.String("fault", "", "For chaos, fail the main, add latency to checks, switch at a random time, or clear every fault")
+    duration := flags.Duration("duration", time.Second * 30, "For chaos, how long the fault lasts, or the window a switch happens in")
+    delay := flags.Duration("delay", 0, "For chaos, how long to wait before the fault starts")
+    latency := flags.Int("latency", 0, "For chaos, milliseconds added to every check")
+    flags.Parse(args[1:])
+
+    if len(c.Addr) == 0 { log.Fatalln("Use -addr= or $TOGGLE_ADDR to say where toggle is running") }
+
+    query := url.Values{}
+    if len(*target) > 0 { query.Set("target", *target) }
+    if *force { query.Set("force", "true") }
+    if name == "chaos" {
+        query = url.Values{ "fault": { *fault }, "duration": { duration.String() }, "delay": { delay.String() } }
+        if *latency > 0 { query.Set("latency", fmt.Sprintf("%d", *latency)) }
+    }
+
+    path := cmd.path
+    if (name == "switch" || name == "chaos") && len(query) > 0 { path += "?" + query.Encode() }
+
+    body, err := c.request(cmd.method, path)
+    if err != nil { log.Fatalln(err) }
+
+    if c.JSON {
+        os.Stdout.Write(body)
+    } else if err = cmd.print(&c, body); err != nil {
+        log.Fatalln(err)
+    }
+    return true
+}
@@ -0,0 +1,348 @@
+/*! \file config.go
+    \brief Loading, validating and writing the toggle config file
+
+    The format is picked from the file extension, .yaml/.yml for YAML, .toml for TOML and anything else is JSON.
+    Unknown fields are rejected and every problem with the file is reported at once.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/BurntSushi/toml"
+    "gopkg.in/yaml.v3"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+    "github.com/NathanRThomas/redisToggle/nginx"
+    "github.com/NathanRThomas/redisToggle/store"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    formatJSON  = "json"
+    formatYAML  = "yaml"
+    formatTOML  = "toml"
+)
+
+var configBackups = 5  //how many old copies of the config we keep when we rewrite it
+
+var hostnameRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type server_t struct {
+    PublicIP    string  `json:"public_ip" yaml:"public_ip" toml:"public_ip"`
+    PrivateIP   string  `json:"private_ip" yaml:"private_ip" toml:"private_ip"`
+    Timeouts    redis.Timeouts_t    `json:"timeouts,omitzero" yaml:"timeouts,omitempty" toml:"timeouts,omitempty"`    //dial, read and write timeouts for this server
+    Priority    int     `json:"priority,omitempty" yaml:"priority,omitempty" toml:"priority,omitzero"`    //the highest is the one we'd rather have as the main, see failback.go
+}
+
+//how we handle servers that are hostnames rather than ip addresses
+type dns_t struct {
+    TTL     int     `json:"ttl,omitempty" yaml:"ttl,omitempty" toml:"ttl,omitzero"`    //seconds to trust a lookup, 0 looks it up at every check
+    SRV     string  `json:"srv,omitempty" yaml:"srv,omitempty" toml:"srv,omitempty"`   //SRV record to get the list of ports from, instead of ports
+}
+
+//where we keep track of the current main so every toggle host agrees, when backend is empty it's just the config file
+type state_t struct {
+    Backend     string  `json:"backend,omitempty" yaml:"backend,omitempty" toml:"backend,omitempty"`  //file, redis, consul or etcd
+    Path        string  `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`           //for file
+    Address     string  `json:"address,omitempty" yaml:"address,omitempty" toml:"address,omitempty"`  //host:port for redis, http://host:port for consul and etcd
+    Key         string  `json:"key,omitempty" yaml:"key,omitempty" toml:"key,omitempty"`
+}
+
+//where alerts go besides the event log
+type alerts_t struct {
+    Webhook     string  `json:"webhook,omitempty" yaml:"webhook,omitempty" toml:"webhook,omitempty"`  //url we post each alert to as json
+}
+
+//app config for what we're monitoring
+type appConfig_t  struct {
+    Main  server_t  `json:"main" yaml:"main" toml:"main"`
+    Subordinate   server_t  `json:"subordinate" yaml:"subordinate" toml:"subordinate"`
+    Ports   []int     `json:"ports" yaml:"ports" toml:"ports"`
+    Nginx   nginx.Options_t `json:"nginx" yaml:"nginx" toml:"nginx"`
+    DNS     dns_t   `json:"dns" yaml:"dns" toml:"dns"`
+    State   state_t `json:"state" yaml:"state" toml:"state"`
+    Alerts  alerts_t    `json:"alerts" yaml:"alerts" toml:"alerts"`
+    Health  redis.Profile_t `json:"health" yaml:"health" toml:"health"`   //how deep each health check goes, see redis/health.go
+    Detection   detection_t `json:"detection" yaml:"detection" toml:"detection"`  //how many checks it takes to decide a server is down, see detector.go
+    SplitBrain  string  `json:"split_brain,omitempty" yaml:"split_brain,omitempty" toml:"split_brain,omitempty"`   //manual, config or offset, see splitbrain.go
+    Failback    failback_t  `json:"failback" yaml:"failback" toml:"failback"`     //what we do once the preferred server is back, see failback.go
+    Damping     damping_t   `json:"damping" yaml:"damping" toml:"damping"`        //limits on how often we switch automatically, see damping.go
+}
+
+//every problem we found with a config file
+type configErrors_t []string
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (e configErrors_t) Error () string {
+    return fmt.Sprintf("%d problem(s) with the config:\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+/*! \brief Returns which format the file is in based on its extension
+*/
+func configFormat (fileLoc string) string {
+    switch strings.ToLower(filepath.Ext(fileLoc)) {
+    case ".yaml", ".yml":
+        return formatYAML
+    case ".toml":
+        return formatTOML
+    }
+    return formatJSON
+}
+
+/*! \brief Decodes the config, rejecting any fields we don't know about
+*/
+func decodeConfig (config *appConfig_t, byt []byte, format string) error {
+    switch format {
+    case formatYAML:
+        dec := yaml.NewDecoder(bytes.NewReader(byt))
+        dec.KnownFields(true)
+        return dec.Decode(config)
+
+    case formatTOML:
+        md, err := toml.Decode(string(byt), config)
+        if err != nil { return err }
+        if undecoded := md.Undecoded(); len(undecoded) > 0 {
+            var errs configErrors_t
+            for _, key := range undecoded {
+                errs = append(errs, fmt.Sprintf("unknown field %s", key.String()))
+            }
+            return errs
+        }
+        return nil
+    }
+
+    dec := json.NewDecoder(bytes.NewReader(byt))
+    dec.DisallowUnknownFields()
+    return dec.Decode(config)
+}
+
+/*! \brief Encodes the config in the format passed in
+*/
+func encodeConfig (config *appConfig_t, format string) ([]byte, error) {
+    switch format {
+    case formatYAML:
+        return yaml.Marshal(config)
+
+    case formatTOML:
+        buf := new(bytes.Buffer)
+        err := toml.NewEncoder(buf).Encode(config)
+        return buf.Bytes(), err
+    }
+    return json.MarshalIndent(*config, "", "    ")
+}
+
+/*! \brief Writes the file through a synced temp file and a rename, keeping the mode of the file it replaces
+*/
+func atomicWrite (fileLoc string, byt []byte) error {
+    mode := os.FileMode(0644)
+    if info, err := os.Stat(fileLoc); err == nil {
+        mode = info.Mode().Perm()
+    }
+
+    dir, base := filepath.Split(fileLoc)
+    if len(dir) == 0 { dir = "." }
+    tmp, err := ioutil.TempFile(dir, "." + base + ".tmp")
+    if err != nil { return err }
+    defer os.Remove(tmp.Name())  //no-op once it's been renamed
+
+    _, err = tmp.Write(byt)
+    if err == nil { err = tmp.Sync() }
+    if cerr := tmp.Close(); err == nil { err = cerr }
+    if err == nil { err = os.Chmod(tmp.Name(), mode) }
+    if err == nil { err = os.Rename(tmp.Name(), fileLoc) }
+    if err != nil { return err }
+
+    //sync the directory too, so the rename itself survives a crash
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    return nil
+}
+
+/*! \brief Copies the current file to a timestamped backup next to it and drops all but the newest configBackups of them
+*/
+func backupConfig (fileLoc string) error {
+    if configBackups < 1 { return nil }
+
+    byt, err := ioutil.ReadFile(fileLoc)
+    if os.IsNotExist(err) { return nil }    //nothing to back up
+    if err != nil { return err }
+
+    if err = atomicWrite(fmt.Sprintf("%s.%s.bak", fileLoc, time.Now().Format("20060102-150405.000")), byt); err != nil {
+        return err
+    }
+
+    backups, err := filepath.Glob(fileLoc + ".*.bak")
+    if err != nil { return err }
+    sort.Strings(backups)   //the timestamp sorts oldest first
+    for len(backups) > configBackups {
+        if err = os.Remove(backups[0]); err != nil { return err }
+        backups = backups[1:]
+    }
+    return nil
+}
+
+/*! \brief Returns true if this looks like an ip address or a hostname we could resolve
+*/
+func validHost (host string) bool {
+    if net.ParseIP(host) != nil { return true }
+    return len(host) <= 253 && hostnameRegex.MatchString(host)
+}
+
+/*! \brief Fills in the defaults and returns every problem with the config
+*/
+func validateConfig (config *appConfig_t) error {
+    //each server can have just one of the addresses set, in which case we use it for both
+    for _, s := range []*server_t{ &config.Main, &config.Subordinate } {
+        if len(s.PublicIP) < 1 { s.PublicIP = s.PrivateIP }
+        if len(s.PrivateIP) < 1 { s.PrivateIP = s.PublicIP }
+    }
+
+    var errs configErrors_t
+    for i, s := range []server_t{ config.Main, config.Subordinate } {
+        name := []string{ "main", "subordinate" }[i]
+        if len(s.PublicIP) < 1 {
+            errs = append(errs, fmt.Sprintf("%s needs a public_ip or private_ip", name))
+            continue
+        }
+        if !validHost(s.PublicIP) { errs = append(errs, fmt.Sprintf("%s public_ip %q isn't a valid ip or hostname", name, s.PublicIP)) }
+        if !validHost(s.PrivateIP) { errs = append(errs, fmt.Sprintf("%s private_ip %q isn't a valid ip or hostname", name, s.PrivateIP)) }
+        for _, e := range s.Timeouts.Validate() {
+            errs = append(errs, fmt.Sprintf("%s %s", name, e))
+        }
+    }
+    if len(config.Main.PublicIP) > 0 && config.Main.PublicIP == config.Subordinate.PublicIP {
+        errs = append(errs, fmt.Sprintf("main and subordinate are both %s", config.Main.PublicIP))
+    }
+
+    if len(config.Ports) < 1 && len(config.DNS.SRV) < 1 {
+        errs = append(errs, "No ports are setup in the config, use ports or dns.srv")
+    }
+    if len(config.DNS.SRV) > 0 && !hostnameRegex.MatchString(strings.Replace(config.DNS.SRV, "_", "", -1)) {
+        errs = append(errs, fmt.Sprintf("dns srv %q isn't a valid record name", config.DNS.SRV))
+    }
+    if config.DNS.TTL < 0 {
+        errs = append(errs, fmt.Sprintf("dns ttl can't be negative: %d", config.DNS.TTL))
+    }
+    seen := make(map[int]bool)
+    for _, port := range config.Ports {
+        if port < 1 || port > 65535 {
+            errs = append(errs, fmt.Sprintf("port %d is out of range", port))
+        } else if seen[port] {
+            errs = append(errs, fmt.Sprintf("port %d is listed more than once", port))
+        }
+        seen[port] = true
+    }
+
+    errs = append(errs, config.Nginx.Validate()...)
+    errs = append(errs, config.Health.Validate()...)
+    errs = append(errs, config.Detection.validate()...)
+    errs = append(errs, config.Failback.validate()...)
+    errs = append(errs, config.Damping.validate()...)
+
+    switch config.SplitBrain {
+    case "", splitBrainManual, splitBrainConfig, splitBrainOffset:
+    default:
+        errs = append(errs, fmt.Sprintf("split_brain %q isn't one of manual, config or offset", config.SplitBrain))
+    }
+    if len(config.Alerts.Webhook) > 0 && !strings.HasPrefix(config.Alerts.Webhook, "http") {
+        errs = append(errs, fmt.Sprintf("alerts webhook %q needs to be an http or https url", config.Alerts.Webhook))
+    }
+
+    switch config.State.Backend {
+    case "":
+    case "file":
+        if len(config.State.Path) < 1 { errs = append(errs, "state backend file needs a path") }
+    case "redis":
+        if _, _, err := net.SplitHostPort(config.State.Address); err != nil {
+            errs = append(errs, fmt.Sprintf("state backend redis needs an address as host:port :: %s", err.Error()))
+        }
+    case "consul", "etcd":
+        if !strings.HasPrefix(config.State.Address, "http") {
+            errs = append(errs, fmt.Sprintf("state backend %s needs an address like http://host:port", config.State.Backend))
+        }
+    default:
+        errs = append(errs, fmt.Sprintf("state backend %q isn't one of file, redis, consul or etcd", config.State.Backend))
+    }
+
+    if len(errs) > 0 {
+        return errs
+    }
+    return nil
+}
+
+/*! \brief Returns the state store the config asks for, nil when we only have the config file
+    The consul ACL token comes from $CONSUL_HTTP_TOKEN so it isn't handed out to subordinates with the rest of the config
+*/
+func newStore (config state_t) store.Store_i {
+    key := config.Key
+    if len(key) == 0 { key = store.DefaultKey }
+
+    switch config.Backend {
+    case "file":
+        return &store.File_c{ Path: config.Path }
+    case "redis":
+        return &store.Redis_c{ Address: config.Address, Key: key }
+    case "consul":
+        return &store.Consul_c{ Address: config.Address, Key: key, Token: os.Getenv("CONSUL_HTTP_TOKEN") }
+    case "etcd":
+        return &store.Etcd_c{ Address: config.Address, Key: key }
+    }
+    return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Reads, decodes and validates the config file
+*/
+func loadConfig (config *appConfig_t, fileLoc string) error {
+    byt, err := ioutil.ReadFile(fileLoc) //try the file
+    if err != nil { return err }
+
+    if err = decodeConfig(config, byt, configFormat(fileLoc)); err != nil {
+        return fmt.Errorf("Unable to parse %s :: %s", fileLoc, err.Error())
+    }
+    return validateConfig(config)
+}
+
+/*! \brief Writes the config back out in the same format the file is in
+    The write goes to a temp file that's synced and renamed over the old one, so a crash part way through never leaves
+    a broken config behind.  The old file is kept as a timestamped backup first, we keep the newest configBackups of those
+*/
+func writeConfig (config *appConfig_t, fileLoc string) {
+    log.Printf("Writing config %s\n", fileLoc)
+    byt, err := encodeConfig(config, configFormat(fileLoc))
+    if err == nil {
+        err = backupConfig(fileLoc)
+    }
+    if err == nil {
+        err = atomicWrite(fileLoc, byt)
+    }
+    if err != nil { log.Printf("Unable to write config %s :: %s\n", fileLoc, err.Error()) }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+//the same config in each format we read
+var testConfigs = map[string]string{
+    formatJSON: `{
+    "main": { "public_ip": "10.0.0.1", "private_ip": "192.168.0.1", "priority": 5 },
+    "subordinate": { "public_ip": "10.0.0.2" },
+    "ports": [ 6379, 6380 ],
+    "nginx": { "max_fails": 2 },
+    "detection": { "fall": 3 },
+    "split_brain": "config"
+}`,
+    formatYAML: `
+main:
+  public_ip: 10.0.0.1
+  private_ip: 192.168.0.1
+  priority: 5
+subordinate:
+  public_ip: 10.0.0.2
+ports: [ 6379, 6380 ]
+nginx:
+  max_fails: 2
+detection:
+  fall: 3
+split_brain: config
+`,
+    formatTOML: `
+ports = [ 6379, 6380 ]
+split_brain = "config"
+
+[main]
+public_ip = "10.0.0.1"
+private_ip = "192.168.0.1"
+priority = 5
+
+[subordinate]
+public_ip = "10.0.0.2"
+
+[nginx]
+max_fails = 2
+
+[detection]
+fall = 3
+`,
+}
+
+//one that passes validation, for tests to break a piece of
+func validTestConfig () appConfig_t {
+    return appConfig_t{ Main: server_t{ PublicIP: testMain }, Subordinate: server_t{ PublicIP: testSub }, Ports: []int{ 6379 } }
+}
+
+func TestConfigFormat (t *testing.T) {
+    for file, format := range map[string]string{ "toggle.conf": formatJSON, "toggle.json": formatJSON, "toggle.YML": formatYAML, "toggle.yaml": formatYAML, "toggle.toml": formatTOML } {
+        if f := configFormat(file); f != format { t.Errorf("%s is %s, expected %s", file, f, format) }
+    }
+}
+
+func TestDecodeConfig (t *testing.T) {
+    for format, text := range testConfigs {
+        var config appConfig_t
+        if err := decodeConfig(&config, []byte(text), format); err != nil { t.Fatalf("%s :: %v", format, err) }
+        if err := validateConfig(&config); err != nil { t.Fatalf("%s :: %v", format, err) }
+
+        if config.Main.PrivateIP != "192.168.0.1" || config.Main.Priority != 5 || !reflect.DeepEqual(config.Ports, []int{ 6379, 6380 }) ||
+            config.Nginx.MaxFails != 2 || config.Detection.Fall != 3 || config.SplitBrain != splitBrainConfig {
+            t.Errorf("%s decoded wrong: %+v", format, config)
+        }
+        if config.Subordinate.PrivateIP != "10.0.0.2" { t.Errorf("%s subordinate private_ip wasn't defaulted to its public_ip: %+v", format, config.Subordinate) }
+    }
+}
+
+func TestDecodeConfigUnknownField (t *testing.T) {
+    unknown := map[string]string{
+        formatJSON: `{ "main": { "public_ip": "10.0.0.1", "publicip": "10.0.0.3" } }`,
+        formatYAML: "main:\n  public_ip: 10.0.0.1\n  publicip: 10.0.0.3\n",
+        formatTOML: "[main]\npublic_ip = \"10.0.0.1\"\npublicip = \"10.0.0.3\"\n",
+    }
+    for format, text := range unknown {
+        var config appConfig_t
+        err := decodeConfig(&config, []byte(text), format)
+        if err == nil || !strings.Contains(err.Error(), "publicip") { t.Errorf("%s didn't reject the unknown field :: %v", format, err) }
+    }
+}
+
+func TestValidateConfig (t *testing.T) {
+    tests := []struct {
+        name    string
+        change  func (c *appConfig_t)
+        expect  string
+    }{
+        { "no main", func (c *appConfig_t) { c.Main = server_t{} }, "main needs a public_ip or private_ip" },
+        { "bad host", func (c *appConfig_t) { c.Subordinate.PublicIP = "not a host" }, "isn't a valid ip or hostname" },
+        { "same servers", func (c *appConfig_t) { c.Subordinate.PublicIP = testMain }, "are both" },
+        { "no ports", func (c *appConfig_t) { c.Ports = nil }, "No ports" },
+        { "port range", func (c *appConfig_t) { c.Ports = []int{ 70000 } }, "out of range" },
+        { "duplicate port", func (c *appConfig_t) { c.Ports = []int{ 6379, 6379 } }, "more than once" },
+        { "split brain", func (c *appConfig_t) { c.SplitBrain = "coin" }, "split_brain" },
+        { "webhook", func (c *appConfig_t) { c.Alerts.Webhook = "example.com" }, "webhook" },
+        { "state backend", func (c *appConfig_t) { c.State.Backend = "zookeeper" }, "state backend" },
+        { "state file", func (c *appConfig_t) { c.State.Backend = "file" }, "needs a path" },
+        { "state redis", func (c *appConfig_t) { c.State = state_t{ Backend: "redis", Address: "10.0.0.3" } }, "host:port" },
+        { "state consul", func (c *appConfig_t) { c.State = state_t{ Backend: "consul", Address: "10.0.0.3:8500" } }, "http://" },
+        { "nginx", func (c *appConfig_t) { c.Nginx.FailTimeout = "soon" }, "fail_timeout" },
+        { "detection", func (c *appConfig_t) { c.Detection.Fall = -1 }, "detection fall" },
+    }
+
+    config := validTestConfig()
+    if err := validateConfig(&config); err != nil { t.Fatalf("Valid config failed :: %v", err) }
+
+    for _, test := range tests {
+        config := validTestConfig()
+        test.change(&config)
+        err := validateConfig(&config)
+        if err == nil || !strings.Contains(err.Error(), test.expect) { t.Errorf("%s: expected %q :: %v", test.name, test.expect, err) }
+    }
+
+    //every problem is reported, not just the first
+    config = validTestConfig()
+    config.Ports, config.SplitBrain = nil, "coin"
+    if errs, ok := validateConfig(&config).(configErrors_t); !ok || len(errs) != 2 { t.Fatalf("Expected both problems: %v", errs) }
+}
+
+func TestWriteConfig (t *testing.T) {
+    defer func (backups int) { configBackups = backups }(configBackups)
+    configBackups = 2
+
+    for _, file := range []string{ "toggle.conf", "toggle.yaml", "toggle.toml" } {
+        fileLoc := filepath.Join(t.TempDir(), file)
+        config := validTestConfig()
+        config.Main.Priority, config.Nginx.MaxFails, config.State = 5, 2, state_t{ Backend: "file", Path: "/tmp/state.json" }
+        if err := validateConfig(&config); err != nil { t.Fatal(err) }
+
+        for i := 0; i < 4; i++ {
+            writeConfig(&config, fileLoc)
+            time.Sleep(2 * time.Millisecond)    //backups are named to the millisecond
+        }
+
+        var loaded appConfig_t
+        if err := loadConfig(&loaded, fileLoc); err != nil { t.Fatalf("%s :: %v", file, err) }
+        if !reflect.DeepEqual(loaded, config) { t.Errorf("%s didn't round trip:\n%+v\n%+v", file, loaded, config) }
+
+        backups, _ := filepath.Glob(fileLoc + ".*.bak")
+        if len(backups) != 2 { t.Errorf("%s kept %d backups, expected 2", file, len(backups)) }
+        files, _ := ioutil.ReadDir(filepath.Dir(fileLoc))
+        if len(files) != 3 { t.Errorf("%s left %d files behind, expected the config and 2 backups", file, len(files)) }
+    }
+}
@@ -0,0 +1,191 @@
+/*! \file connections.go
+    \brief Keeps a connection pool open to every server on every port, instead of opening one for each check
+
+    A pool is only replaced when the server stops answering, its hostname moves or its timeouts change.  When we can't
+    connect we back off before trying again, doubling each time up to maxBackoff, so a dead server isn't hammered.
+    Each server and port has its own lock that's held while we dial, the map's lock is only held to find it, so a host
+    that's blackholed only holds up the checks on that host and port.
+*/
+
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    connPoolSize    = 2     //a check and a role change can overlap, we never need more than that
+    minBackoff      = time.Millisecond * 500
+    maxBackoff      = time.Second * 30
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//counters for how much we're connecting and disconnecting, reported in the status
+type connStats_t struct {
+    Open        int     `json:"open"`           //pools we're holding right now
+    Connects    int64   `json:"connects"`       //pools we've opened
+    Failures    int64   `json:"failures"`       //times we couldn't open one
+    Drops       int64   `json:"drops"`          //pools closed because the server stopped answering
+    Reuses      int64   `json:"reuses"`         //times an open pool was used again
+}
+
+type conn_t struct {
+    lock        sync.Mutex      //held while we dial, protects everything below
+    removed     bool            //no longer in the map, anything we connect gets closed
+    r           redis.Client_i
+    ip          string          //what the host resolved to when we connected
+    timeouts    redis.Timeouts_t
+    connected   bool
+    failures    int             //failed connects in a row
+    retryAt     time.Time       //no connecting before this
+    lastErr     error
+}
+
+type connections_c struct {
+    lock        sync.Mutex          //protects conns and stats, never held while a conn_t's lock is being waited on
+    conns       map[string]*conn_t  //keyed by host:port
+    stats       connStats_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (c *conn_t) close () {
+    if c.connected { c.r.Close() }
+    c.connected = false
+}
+
+/*! \brief Applies a change to the counters
+*/
+func (c *connections_c) count (fn func (stats *connStats_t)) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    fn(&c.stats)
+}
+
+/*! \brief Returns the entry for the server on this port, making it if it's new
+*/
+func (c *connections_c) entry (key string) *conn_t {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.conns == nil { c.conns = make(map[string]*conn_t) }
+    conn, ok := c.conns[key]
+    if !ok {
+        conn = &conn_t{}
+        c.conns[key] = conn
+    }
+    return conn
+}
+
+/*! \brief Returns the client for the server on this port, connecting if we don't have one that's still good
+*/
+func (c *connections_c) get (dial redis.Dialer_f, host, ip string, port int, timeouts redis.Timeouts_t) (redis.Client_i, error) {
+    key := fmt.Sprintf("%s:%d", host, port)
+    conn := c.entry(key)
+    conn.lock.Lock()
+    defer conn.lock.Unlock()
+
+    if conn.connected {
+        if conn.ip == ip && conn.timeouts == timeouts {
+            c.count(func (stats *connStats_t) { stats.Reuses++ })
+            return conn.r, nil
+        }
+        conn.close()    //it moved, or the settings changed, start again
+        c.count(func (stats *connStats_t) { stats.Open-- })
+    }
+
+    if time.Now().Before(conn.retryAt) {
+        return nil, fmt.Errorf("Waiting until %s to reconnect to %s :: %s", conn.retryAt.Format("15:04:05.000"), key, conn.lastErr.Error())
+    }
+
+    r, err := dial(ip, port, timeouts)
+    if err != nil {
+        backoff := minBackoff << uint(conn.failures)
+        if backoff > maxBackoff || backoff <= 0 { backoff = maxBackoff }
+        conn.failures++
+        conn.retryAt = time.Now().Add(backoff)
+        conn.lastErr = err
+        c.count(func (stats *connStats_t) { stats.Failures++ })
+        return nil, err
+    }
+    c.count(func (stats *connStats_t) { stats.Connects++ })
+
+    if conn.removed {   //the config changed while we were dialing, so nobody's going to hang on to this
+        r.Close()
+        return nil, fmt.Errorf("No longer checking %s", key)
+    }
+    conn.r = r
+    conn.ip, conn.timeouts, conn.connected = ip, timeouts, true
+    conn.failures, conn.retryAt = 0, time.Time{}
+    c.count(func (stats *connStats_t) { stats.Open++ })
+    return conn.r, nil
+}
+
+/*! \brief Closes the pool for the server on this port because it stopped answering, the next get opens a new one
+    If it's still being dialed this waits for that to finish
+*/
+func (c *connections_c) drop (host string, port int) {
+    c.lock.Lock()
+    conn, ok := c.conns[fmt.Sprintf("%s:%d", host, port)]
+    c.lock.Unlock()
+    if !ok { return }
+
+    conn.lock.Lock()
+    defer conn.lock.Unlock()
+    if conn.connected {
+        conn.close()
+        c.count(func (stats *connStats_t) { stats.Drops++; stats.Open-- })
+    }
+}
+
+/*! \brief Closes the pools for anything that's not one of these hosts on one of these ports, after the config changes
+*/
+func (c *connections_c) retain (hosts []string, ports []int) {
+    keep := make(map[string]bool)
+    for _, host := range hosts {
+        for _, port := range ports {
+            keep[fmt.Sprintf("%s:%d", host, port)] = true
+        }
+    }
+
+    var removed []*conn_t
+    c.lock.Lock()
+    for key, conn := range c.conns {
+        if keep[key] { continue }
+        removed = append(removed, conn)
+        delete(c.conns, key)
+    }
+    c.lock.Unlock()
+
+    for _, conn := range removed {
+        conn.lock.Lock()
+        conn.removed = true
+        if conn.connected { c.count(func (stats *connStats_t) { stats.Open-- }) }
+        conn.close()
+        conn.lock.Unlock()
+    }
+}
+
+/*! \brief Closes every pool, call this when we're shutting down
+*/
+func (c *connections_c) closeAll () {
+    c.retain(nil, nil)
+}
+
+func (c *connections_c) report () connStats_t {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.stats
+}
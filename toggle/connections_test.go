@@ -0,0 +1,55 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+    "github.com/NathanRThomas/redisToggle/redis/redistest"
+)
+
+func TestConnectionsReuse (t *testing.T) {
+    network := &redistest.FakeNetwork_c{}
+    c := &connections_c{}
+
+    for i := 0; i < 3; i++ {
+        if _, err := c.get(network.Dial, testMain, testMain, 6379, redis.Timeouts_t{}); err != nil { t.Fatal(err) }
+    }
+    if stats := c.report(); stats.Connects != 1 || stats.Reuses != 2 || stats.Open != 1 { t.Fatalf("Pool wasn't reused: %+v", stats) }
+
+    c.drop(testMain, 6379)
+    if _, err := c.get(network.Dial, testMain, testMain, 6379, redis.Timeouts_t{}); err != nil { t.Fatal(err) }
+    if stats := c.report(); stats.Connects != 2 || stats.Drops != 1 || stats.Open != 1 { t.Fatalf("Pool wasn't replaced after the drop: %+v", stats) }
+}
+
+func TestConnectionsHungDial (t *testing.T) {
+    network := &redistest.FakeNetwork_c{}
+    c := &connections_c{}
+    started, release := make(chan struct{}), make(chan struct{})
+    dial := func (ip string, port int, timeouts redis.Timeouts_t) (redis.Client_i, error) {
+        if port == 6380 {   //blackholed
+            close(started)
+            <-release
+        }
+        return network.Dial(ip, port, timeouts)
+    }
+
+    go c.get(dial, testMain, testMain, 6380, redis.Timeouts_t{})
+    <-started
+
+    done := make(chan error, 1)
+    go func () {
+        _, err := c.get(dial, testMain, testMain, 6379, redis.Timeouts_t{})
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if err != nil { t.Fatal(err) }
+    case <-time.After(time.Second):
+        t.Fatal("A hung dial on one port held up connecting to another")
+    }
+    close(release)
+
+    c.closeAll()
+    if stats := c.report(); stats.Open != 0 { t.Fatalf("Pools still open after closeAll: %+v", stats) }
+}
@@ -0,0 +1,84 @@
+/*! \file damping.go
+    \brief Stops us switching back and forth when both servers are unstable
+
+    Every automatic switch, a failover, a forced chaos switch or a failback, has to get past the damping settings
+        min_interval    - seconds since the last automatic switch before we'll do another one
+        max_per_hour    - once we've switched this many times in an hour automatic failover is paused and an alert is raised
+        holddown        - seconds the subordinate has to have been up, without a failed check, before it can become the main
+    Switches someone asks for through the api or a signal are never held up.  All of them default to 0, which is no limit.
+*/
+
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//limits on automatic switches, from the config file
+type damping_t struct {
+    MinInterval int     `json:"min_interval,omitempty" yaml:"min_interval,omitempty" toml:"min_interval,omitzero"`  //seconds between automatic switches
+    MaxPerHour  int     `json:"max_per_hour,omitempty" yaml:"max_per_hour,omitempty" toml:"max_per_hour,omitzero"`  //automatic switches in an hour before failover is paused
+    Holddown    int     `json:"holddown,omitempty" yaml:"holddown,omitempty" toml:"holddown,omitzero"`              //seconds a server needs to be up before it can be the main
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns anything wrong with the settings
+*/
+func (d damping_t) validate () (errs []string) {
+    if d.MinInterval < 0 || d.MaxPerHour < 0 || d.Holddown < 0 {
+        errs = append(errs, "damping min_interval, max_per_hour and holddown can't be negative")
+    }
+    return
+}
+
+func (d damping_t) holddown () time.Duration {
+    return time.Second * time.Duration(d.Holddown)
+}
+
+/*! \brief Returns why we can't switch to the subordinate automatically right now, empty if we can
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) damped (now time.Time) string {
+    settings := t.Config.Damping
+    if len(t.switches) > 0 && settings.MinInterval > 0 {
+        last := t.switches[len(t.switches)-1]
+        if wait := time.Second * time.Duration(settings.MinInterval) - now.Sub(last); wait > 0 {
+            return fmt.Sprintf("last switch was at %s, waiting another %s", last.Format("15:04:05"), wait.Round(time.Second))
+        }
+    }
+
+    if settings.Holddown > 0 {
+        for _, port := range t.Config.Ports {
+            d := t.detector(t.Config.Subordinate.PublicIP, port)
+            if up := d.upFor(now); up < settings.holddown() {
+                return fmt.Sprintf("%s:%d has only been up for %s of %s", t.Config.Subordinate.PublicIP, port, up.Round(time.Second), settings.holddown())
+            }
+        }
+    }
+    return ""
+}
+
+/*! \brief Records an automatic switch, pausing failover if we've done too many in the last hour
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) recordSwitch (now time.Time) {
+    keep := t.switches[:0]
+    for _, s := range t.switches {
+        if now.Sub(s) < time.Hour { keep = append(keep, s) }
+    }
+    t.switches = append(keep, now)
+
+    max := t.Config.Damping.MaxPerHour
+    if max > 0 && len(t.switches) >= max && !t.status.Paused() {
+        t.Pause(true)   //someone needs to look at this, they'll need to resume afterwards
+        t.alert("flapping", fmt.Sprintf("Switched %d times in the last hour, automatic failover is paused until it's resumed", len(t.switches)))
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestDampingMinInterval (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Damping = damping_t{ MinInterval: 3600 }
+    tasks.switches = []time.Time{ time.Now() }
+    network.Server(testMain, 6379).SetDown(true)
+
+    if tasks.Check() { t.Fatal("Switched again within min_interval") }
+    if !hasEvent(tasks, "damped") { t.Fatalf("Missing damped event: %+v", tasks.History()) }
+
+    tasks.switches[0] = time.Now().Add(-time.Hour)
+    if !tasks.Check() { t.Fatal("Didn't switch once min_interval was up") }
+}
+
+func TestDampingMaxPerHour (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Damping = damping_t{ MaxPerHour: 2 }
+    tasks.switches = []time.Time{ time.Now().Add(-time.Hour * 2), time.Now().Add(-time.Minute) }   //only one of these counts
+    network.Server(testMain, 6379).SetDown(true)
+
+    if !tasks.Check() { t.Fatal("Check didn't switch with the main down") }
+    if len(tasks.switches) != 2 { t.Fatalf("Old switches weren't forgotten: %v", tasks.switches) }
+    if !tasks.status.Paused() || !hasEvent(tasks, "flapping") { t.Fatalf("Failover wasn't paused after too many switches: %+v", tasks.History()) }
+}
+
+func TestDampingHolddown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Damping = damping_t{ Holddown: 60 }
+    network.Server(testMain, 6379).SetDown(true)
+
+    if tasks.Check() { t.Fatal("Switched to a subordinate that's only just been seen up") }
+    if !hasEvent(tasks, "damped") { t.Fatalf("Missing damped event: %+v", tasks.History()) }
+
+    d := tasks.detector(testSub, 6379)
+    if d.upFor(time.Now().Add(time.Minute)) < time.Minute { t.Fatal("Subordinate wasn't seen up") }
+    d.upSince = d.upSince.Add(-time.Minute)
+    if !tasks.Check() { t.Fatal("Didn't switch once the subordinate had been up for long enough") }
+
+    //the old main fails its check, so it has to start over before it could take back over
+    if tasks.detector(testMain, 6379).upFor(time.Now()) != 0 { t.Fatal("Old main still counted as up") }
+}
@@ -0,0 +1,192 @@
+/*! \file demoter.go
+    \brief Keeps trying to turn an old main into a subordinate of the new one until it works
+
+    There's one worker per server and port.  Starting another for the same one replaces it, promoting the server cancels
+    it, and Close cancels them all.  Each attempt holds the worker's own lock and checks it hasn't been cancelled first,
+    so once cancel returns a stale worker can't demote a server that's since become the main again.
+    Retries back off from demoteRetry, doubling up to maxDemoteRetry.
+*/
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+var (
+    demoteRetry     = time.Second * 5   //how long we wait before trying to demote an old main again, a var so tests can shorten it
+    maxDemoteRetry  = time.Minute * 5   //longest we wait between attempts
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//what we report about a worker through the status
+type demotion_t struct {
+    Host        string      `json:"host"`
+    Port        int         `json:"port"`
+    NewMain     string      `json:"new_main"`
+    Started     time.Time   `json:"started"`
+    Attempts    int         `json:"attempts"`
+    NextTry     time.Time   `json:"next_try"`
+    LastError   string      `json:"last_error,omitempty"`
+}
+
+type demotion_c struct {
+    info        demotion_t  //protected by demoter_c.lock
+    generation  uint64
+    attempt     func () error
+    lock        sync.Mutex  //held for each attempt, so cancelling waits for one that's in flight
+    cancelled   bool
+    stop        chan struct{}
+}
+
+type demoter_c struct {
+    lock        sync.Mutex
+    workers     map[string]*demotion_c  //keyed by host:port
+    generation  uint64                  //bumped for every worker, so one that finishes never removes the worker that replaced it
+    wg          sync.WaitGroup
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Stops the worker, once this returns it won't make another attempt
+*/
+func (w *demotion_c) cancel () {
+    close(w.stop)
+    w.lock.Lock()
+    w.cancelled = true
+    w.lock.Unlock()
+}
+
+/*! \brief Tries once, unless we've been cancelled, returns true when there's nothing left to do
+*/
+func (d *demoter_c) try (key string, w *demotion_c) bool {
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    if w.cancelled { return true }
+
+    err := w.attempt()
+
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    w.info.Attempts++
+    if err != nil {
+        w.info.LastError = err.Error()
+        return false
+    }
+    if cur, ok := d.workers[key]; ok && cur.generation == w.generation {
+        delete(d.workers, key)
+    }
+    return true
+}
+
+/*! \brief Retries until it works or we're cancelled
+*/
+func (d *demoter_c) run (key string, w *demotion_c) {
+    defer d.wg.Done()
+    wait := demoteRetry
+    for {
+        select {
+        case <-w.stop:
+            return
+        case <-time.After(wait):
+        }
+        if d.try(key, w) { return }
+
+        wait *= 2
+        if wait > maxDemoteRetry { wait = maxDemoteRetry }
+        d.lock.Lock()
+        w.info.NextTry = time.Now().Add(wait)
+        d.lock.Unlock()
+    }
+}
+
+/*! \brief Demotes the server, trying once right away and handing it to a worker if that doesn't work
+    Returns true if it worked the first time
+*/
+func (d *demoter_c) start (host string, port int, newMain string, attempt func () error) bool {
+    key := fmt.Sprintf("%s:%d", host, port)
+    d.cancel(host, port)    //only ever one per server and port
+
+    d.lock.Lock()
+    d.generation++
+    w := &demotion_c{ generation: d.generation, attempt: attempt, stop: make(chan struct{}),
+        info: demotion_t{ Host: host, Port: port, NewMain: newMain, Started: time.Now(), NextTry: time.Now().Add(demoteRetry) } }
+    if d.workers == nil { d.workers = make(map[string]*demotion_c) }
+    d.workers[key] = w
+    d.lock.Unlock()
+
+    if d.try(key, w) { return true }
+
+    d.wg.Add(1)
+    go d.run(key, w)
+    return false
+}
+
+/*! \brief Stops any worker demoting this server, call it before promoting the server
+*/
+func (d *demoter_c) cancel (host string, port int) {
+    key := fmt.Sprintf("%s:%d", host, port)
+    d.lock.Lock()
+    w, ok := d.workers[key]
+    delete(d.workers, key)
+    d.lock.Unlock()
+    if ok { w.cancel() }
+}
+
+/*! \brief Stops every worker and waits for them to finish
+*/
+func (d *demoter_c) stopAll () {
+    d.lock.Lock()
+    workers := d.workers
+    d.workers = nil
+    d.lock.Unlock()
+
+    for _, w := range workers {
+        w.cancel()
+    }
+    d.wg.Wait()
+}
+
+/*! \brief Returns every worker that's still trying
+*/
+func (d *demoter_c) report () []demotion_t {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    ret := make([]demotion_t, 0, len(d.workers))
+    for _, w := range d.workers {
+        ret = append(ret, w.info)
+    }
+    sort.Slice(ret, func (i, j int) bool {
+        if ret[i].Host != ret[j].Host { return ret[i].Host < ret[j].Host }
+        return ret[i].Port < ret[j].Port
+    })
+    return ret
+}
+
+/*! \brief Turns the old main into a subordinate of the new one, retrying in the background until it does
+*/
+func (t *tasks_c) mainToSubordinate (targetIP, newMainIP string, targetPort int) {
+    worked := t.demoter.start(targetIP, targetPort, newMainIP, func () error {
+        err := t.subordinateof(targetIP, targetPort, newMainIP, fmt.Sprintf("%d", targetPort))
+        if err == nil {
+            log.Printf("Old main %s:%d converted to subordinate of %s", targetIP, targetPort, newMainIP)  //log that this completed
+        }
+        return err
+    })
+    if !worked {
+        t.events.Add("demote", fmt.Sprintf("Unable to demote old main %s:%d yet, retrying in the background", targetIP, targetPort))
+    }
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestMainToSubordinate (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    main := network.Server(testMain, 6379)
+
+    tasks.mainToSubordinate(testMain, testSub, 6379)
+    if !hasCall(main, "SLAVEOF " + testSub + " 6379") { t.Fatalf("Main wasn't demoted: %v", main.Calls()) }
+}
+
+func TestMainToSubordinateRetries (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    main := network.Server(testMain, 6379)
+    main.SetDown(true)
+
+    tasks.mainToSubordinate(testMain, testSub, 6379)
+    time.Sleep(demoteRetry * 5)
+    if !main.Role().Main { t.Fatal("A server that's down was demoted") }
+    if d := tasks.Status().Demotions; len(d) != 1 || d[0].Attempts < 2 || len(d[0].LastError) == 0 { t.Fatalf("Demotion wasn't reported: %+v", d) }
+
+    main.SetDown(false)
+    waitForRole(t, main, testSub, 6379)
+    time.Sleep(demoteRetry)
+    if d := tasks.Status().Demotions; len(d) != 0 { t.Fatalf("Finished demotion still reported: %+v", d) }
+}
+
+func TestMainToSubordinateReplaced (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    main := network.Server(testMain, 6379)
+    main.SetDown(true)
+
+    tasks.mainToSubordinate(testMain, "10.0.0.8", 6379)
+    tasks.mainToSubordinate(testMain, testSub, 6379)   //a later switch replaces the first worker
+    if d := tasks.Status().Demotions; len(d) != 1 || d[0].NewMain != testSub { t.Fatalf("Workers weren't replaced: %+v", d) }
+
+    main.SetDown(false)
+    waitForRole(t, main, testSub, 6379)
+    time.Sleep(maxDemoteRetry * 2)
+    if hasCall(main, "SLAVEOF 10.0.0.8 6379") { t.Fatalf("Stale worker demoted the server: %v", main.Calls()) }
+}
+
+func TestMainToSubordinateCancelled (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    sub := network.Server(testSub, 6379)
+    sub.SetDown(true)
+
+    tasks.mainToSubordinate(testSub, testMain, 6379)  //as if the subordinate was an old main that never came back
+    tasks.demoter.cancel(testSub, 6379)               //and then was promoted
+    sub.SetDown(false)
+    time.Sleep(maxDemoteRetry * 2)
+    if len(sub.Calls()) != 0 { t.Fatalf("Cancelled worker kept going: %v", sub.Calls()) }
+
+    sub.SetDown(true)
+    tasks.mainToSubordinate(testSub, testMain, 6379)
+    tasks.Close()   //stops the workers too
+    if d := tasks.Status().Demotions; len(d) != 0 { t.Fatalf("Close left workers running: %+v", d) }
+}
@@ -0,0 +1,171 @@
+/*! \file detector.go
+    \brief Decides when a redis server is down, or up again, from the results of its health checks
+
+    A single failed check doesn't mean much, so a server is only marked down after fall failures in a row, all within
+    window seconds of each other, and only marked up again after rise successes in a row.  Each server on each port
+    gets its own detector, they don't know anything about redis, they just count.
+*/
+
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    defaultFall = 2     //one failed check plus the retry, which is what we've always done
+    defaultRise = 1
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//how we decide a server is down, from the config file
+type detection_t struct {
+    Fall        int     `json:"fall,omitempty" yaml:"fall,omitempty" toml:"fall,omitzero"`               //failed checks in a row before a server is down, 2 when not set
+    Rise        int     `json:"rise,omitempty" yaml:"rise,omitempty" toml:"rise,omitzero"`               //good checks in a row before a down server is up again, 1 when not set
+    Window      int     `json:"window,omitempty" yaml:"window,omitempty" toml:"window,omitzero"`         //seconds the failures need to happen within, 0 for no limit
+    JitterMs    int     `json:"jitter_ms,omitempty" yaml:"jitter_ms,omitempty" toml:"jitter_ms,omitzero"` //up to this much random delay before each check, so hosts don't all check at once
+    TimeoutMs   int     `json:"timeout_ms,omitempty" yaml:"timeout_ms,omitempty" toml:"timeout_ms,omitzero"` //a check taking longer than this counts as a failure, 0 for no limit
+}
+
+type detector_c struct {
+    fall, rise  int
+    window      time.Duration
+    down        bool
+    failures    []time.Time     //the current run of failed checks
+    successes   int             //the current run of good checks
+    upSince     time.Time       //when it came up, or was first seen up, zero while it's failing
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns anything wrong with the settings
+*/
+func (d detection_t) validate () (errs []string) {
+    for name, val := range map[string]int{ "fall": d.Fall, "rise": d.Rise, "window": d.Window, "jitter_ms": d.JitterMs, "timeout_ms": d.TimeoutMs } {
+        if val < 0 { errs = append(errs, fmt.Sprintf("detection %s can't be negative: %d", name, val)) }
+    }
+    sort.Strings(errs)  //map order is random, keep the report stable
+    return
+}
+
+func (d detection_t) jitter () time.Duration {
+    if d.JitterMs < 1 { return 0 }
+    return time.Duration(rand.Intn(d.JitterMs)) * time.Millisecond
+}
+
+func (d detection_t) timeout () time.Duration {
+    return time.Duration(d.TimeoutMs) * time.Millisecond
+}
+
+/*! \brief Takes the settings from the config, keeping whatever the detector has counted so far
+*/
+func (d *detector_c) configure (settings detection_t) {
+    d.fall, d.rise = settings.Fall, settings.Rise
+    if d.fall < 1 { d.fall = defaultFall }
+    if d.rise < 1 { d.rise = defaultRise }
+    d.window = time.Second * time.Duration(settings.Window)
+}
+
+/*! \brief Records the result of a check, returns true if this changed whether the server is down
+*/
+func (d *detector_c) observe (ok bool, now time.Time) bool {
+    if ok {
+        d.failures = d.failures[:0]
+        d.successes++
+        if d.down && d.successes >= d.rise {
+            d.down = false
+            d.upSince = now
+            return true
+        }
+        if !d.down && d.upSince.IsZero() { d.upSince = now }
+        return false
+    }
+
+    d.successes = 0
+    d.upSince = time.Time{}     //any failure starts the clock over
+    d.failures = append(d.failures, now)
+    if d.window > 0 {   //forget failures that are too old to count towards this run
+        for len(d.failures) > 0 && now.Sub(d.failures[0]) > d.window {
+            d.failures = d.failures[1:]
+        }
+    }
+    if !d.down && len(d.failures) >= d.fall {
+        d.down = true
+        return true
+    }
+    return false
+}
+
+/*! \brief Returns how long the server's been up without a failed check, 0 if it's down or failing
+*/
+func (d *detector_c) upFor (now time.Time) time.Duration {
+    if d.down || d.upSince.IsZero() { return 0 }
+    return now.Sub(d.upSince)
+}
+
+/*! \brief Returns true if the server's been seen up and hasn't been marked down since
+*/
+func (d *detector_c) up () bool {
+    return !d.down && !d.upSince.IsZero()
+}
+
+/*! \brief Returns how many more failed checks it'll take before the server is down, 0 if it already is
+*/
+func (d *detector_c) remaining () int {
+    if d.down { return 0 }
+    return d.fall - len(d.failures)
+}
+
+/*! \brief Returns the detector for the server on this port, making it if this is the first we've seen of it
+*/
+func (t *tasks_c) detector (host string, port int) *detector_c {
+    key := fmt.Sprintf("%s:%d", host, port)
+    if t.detectors == nil { t.detectors = make(map[string]*detector_c) }
+    d, ok := t.detectors[key]
+    if !ok {
+        d = &detector_c{}
+        d.configure(t.Config.Detection)
+        t.detectors[key] = d
+    }
+    return d
+}
+
+/*! \brief Runs a health check and feeds the result to the server's detector, returns true if the server's up
+    A server that's failing, but not for long enough yet, is still up
+*/
+func (t *tasks_c) observe (host string, port int, mainFlag bool) (up, ok bool) {
+    ok = t.checkRedis(host, port, mainFlag)
+    d := t.detector(host, port)
+    if d.observe(ok, time.Now()) {
+        if d.down {
+            t.events.Add("down", fmt.Sprintf("Redis server %s:%d marked down after %d failed checks", host, port, d.fall))
+        } else {
+            t.events.Add("up", fmt.Sprintf("Redis server %s:%d marked up after %d good checks", host, port, d.rise))
+        }
+    }
+    return !d.down, ok
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns a random delay to wait before the next check, based on the jitter in our config
+*/
+func (t *tasks_c) Jitter () time.Duration {
+    t.cfgLock.RLock()
+    defer t.cfgLock.RUnlock()
+    return t.Config.Detection.jitter()
+}
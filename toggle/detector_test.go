@@ -0,0 +1,22 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestDetector (t *testing.T) {
+    d := &detector_c{}
+    d.configure(detection_t{ Fall: 3, Rise: 2, Window: 10 })
+    now := time.Now()
+
+    d.observe(false, now)
+    if d.observe(false, now.Add(time.Second * 20)) { t.Fatal("Marked down with failures outside the window") }
+    if d.remaining() != 2 { t.Fatalf("Expected 2 more failures before down, got %d", d.remaining()) }
+
+    d.observe(false, now.Add(time.Second * 21))
+    if !d.observe(false, now.Add(time.Second * 22)) || !d.down { t.Fatal("Not marked down after 3 failures in the window") }
+
+    if d.observe(true, now) { t.Fatal("Marked up after 1 good check with rise 2") }
+    if !d.observe(true, now) || d.down { t.Fatal("Not marked up after 2 good checks") }
+}
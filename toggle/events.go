@@ -0,0 +1,57 @@
+/*! \file events.go
+    \brief Keeps a short history of the interesting things toggle has done, switches, pauses and the like
+*/
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const maxEvents = 200   //how many events we hang on to, oldest ones get dropped first
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type event_t struct {
+    Time        time.Time   `json:"time"`
+    Kind        string      `json:"kind"`
+    Message     string      `json:"message"`
+}
+
+type events_c struct {
+    lock    sync.RWMutex
+    list    []event_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Records a new event and logs it
+*/
+func (e *events_c) Add (kind, message string) {
+    log.Printf("%s: %s\n", kind, message)
+
+    e.lock.Lock()
+    defer e.lock.Unlock()
+    e.list = append(e.list, event_t{ Time: time.Now(), Kind: kind, Message: message })
+    if len(e.list) > maxEvents {
+        e.list = e.list[len(e.list) - maxEvents:]
+    }
+}
+
+/*! \brief Returns a copy of the events we have, oldest first
+*/
+func (e *events_c) List () []event_t {
+    e.lock.RLock()
+    defer e.lock.RUnlock()
+    return append([]event_t{}, e.list...)
+}
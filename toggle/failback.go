@@ -0,0 +1,177 @@
+/*! \file failback.go
+    \brief Moving the main back to the preferred server once it's recovered from a failover
+
+    Which server we prefer is its priority in the config, the highest wins.  When they're the same, it's whichever server
+    was the main before our last automatic failover.  The failback policy decides what happens once that server is back
+        never   - (default) it stays a subordinate until someone switches by hand
+        auto    - once it's been up and replicating within max_lag_bytes of the main for stable seconds, we switch back
+        window  - same as auto, except the switch only happens during the daily window, like "02:00-04:00" local time
+    The switch back is always a graceful one, so no writes are lost, and if it fails we start counting stable again.
+*/
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    failbackNever   = "never"
+    failbackAuto    = "auto"
+    failbackWindow  = "window"
+
+    defaultFailbackStable   = 300       //seconds
+    defaultFailbackLag      = 1 << 20   //bytes, the graceful switch waits for the rest with writes paused
+    defaultFailbackTimeout  = 10        //seconds
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//what we do once the preferred server is back, from the config file
+type failback_t struct {
+    Mode        string  `json:"mode,omitempty" yaml:"mode,omitempty" toml:"mode,omitempty"`          //never, auto or window
+    Stable      int     `json:"stable,omitempty" yaml:"stable,omitempty" toml:"stable,omitzero"`     //seconds it needs to be synced before we switch back, 300 when not set
+    MaxLagBytes int64   `json:"max_lag_bytes,omitempty" yaml:"max_lag_bytes,omitempty" toml:"max_lag_bytes,omitzero"` //how far behind the main still counts as synced, 1MB when not set
+    Window      string  `json:"window,omitempty" yaml:"window,omitempty" toml:"window,omitempty"`    //HH:MM-HH:MM local time, for window
+    Timeout     int     `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitzero"`  //seconds the graceful switch gets, 10 when not set
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the window as minutes since midnight
+*/
+func parseWindow (window string) (start, end int, err error) {
+    parts := strings.Split(window, "-")
+    if len(parts) != 2 { return 0, 0, fmt.Errorf("failback window %q needs to be like 02:00-04:00", window) }
+
+    var mins [2]int
+    for i, part := range parts {
+        tm, err := time.Parse("15:04", strings.TrimSpace(part))
+        if err != nil { return 0, 0, fmt.Errorf("failback window %q needs to be like 02:00-04:00", window) }
+        mins[i] = tm.Hour() * 60 + tm.Minute()
+    }
+    if mins[0] == mins[1] { return 0, 0, fmt.Errorf("failback window %q starts and ends at the same time", window) }
+    return mins[0], mins[1], nil
+}
+
+/*! \brief Returns anything wrong with the settings
+*/
+func (f failback_t) validate () (errs []string) {
+    switch f.Mode {
+    case "", failbackNever, failbackAuto:
+    case failbackWindow:
+        if _, _, err := parseWindow(f.Window); err != nil { errs = append(errs, err.Error()) }
+    default:
+        errs = append(errs, fmt.Sprintf("failback mode %q isn't one of never, auto or window", f.Mode))
+    }
+    if f.Stable < 0 || f.MaxLagBytes < 0 || f.Timeout < 0 {
+        errs = append(errs, "failback stable, max_lag_bytes and timeout can't be negative")
+    }
+    return
+}
+
+func (f failback_t) enabled () bool {
+    return f.Mode == failbackAuto || f.Mode == failbackWindow
+}
+
+func (f failback_t) stable () time.Duration {
+    if f.Stable < 1 { return time.Second * defaultFailbackStable }
+    return time.Second * time.Duration(f.Stable)
+}
+
+func (f failback_t) maxLag () int64 {
+    if f.MaxLagBytes < 1 { return defaultFailbackLag }
+    return f.MaxLagBytes
+}
+
+func (f failback_t) timeout () time.Duration {
+    if f.Timeout < 1 { return time.Second * defaultFailbackTimeout }
+    return time.Second * time.Duration(f.Timeout)
+}
+
+/*! \brief Returns true if we're allowed to fail back at this time
+*/
+func (f failback_t) allowed (now time.Time) bool {
+    if f.Mode != failbackWindow { return true }
+    start, end, err := parseWindow(f.Window)
+    if err != nil { return false }
+
+    mins := now.Hour() * 60 + now.Minute()
+    if start < end { return mins >= start && mins < end }
+    return mins >= start || mins < end  //wraps past midnight
+}
+
+/*! \brief Returns true if the subordinate is the server we'd rather have as the main
+*/
+func (t *tasks_c) prefersSubordinate () bool {
+    if t.Config.Subordinate.Priority != t.Config.Main.Priority {
+        return t.Config.Subordinate.Priority > t.Config.Main.Priority
+    }
+    return len(t.failedFrom) > 0 && t.failedFrom == t.Config.Subordinate.PublicIP
+}
+
+/*! \brief Returns why the subordinate isn't ready to be the main again, empty if it is
+*/
+func (t *tasks_c) failbackBlocker () string {
+    for _, port := range t.Config.Ports {   //checkPort has already looked at it this check, see watchSubordinate
+        if !t.detector(t.Config.Subordinate.PublicIP, port).up() {
+            return fmt.Sprintf("%s:%d isn't up", t.Config.Subordinate.PublicIP, port)
+        }
+    }
+    for _, p := range t.topology() {
+        if p.main.err != nil || p.sub.err != nil { return fmt.Sprintf("port %d: %s; %s", p.port, p.main, p.sub) }
+        if !p.main.role.Main || !t.replicatesFrom(p.sub.role, t.Config.Main, p.port) || !p.sub.role.LinkUp {
+            return fmt.Sprintf("port %d isn't replicating: %s; %s", p.port, p.main, p.sub)
+        }
+        if lag := p.main.role.Offset - p.sub.role.Offset; lag > t.Config.Failback.maxLag() {
+            return fmt.Sprintf("%s:%d is %d bytes behind", p.sub.host, p.port, lag)
+        }
+    }
+    return ""
+}
+
+/*! \brief Switches back to the preferred server once it's been synced long enough, returns true if it did
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) checkFailback (now time.Time) bool {
+    policy := t.Config.Failback
+    if !policy.enabled() || t.status.Paused() || t.splitBrain || !t.prefersSubordinate() {
+        t.failbackSince = time.Time{}
+        return false
+    }
+
+    sub := t.Config.Subordinate.PublicIP
+    if reason := t.failbackBlocker(); len(reason) > 0 {
+        if !t.failbackSince.IsZero() {
+            t.events.Add("failback", fmt.Sprintf("Failback to %s is waiting again :: %s", sub, reason))
+            t.failbackSince = time.Time{}
+        }
+        return false
+    }
+
+    if t.failbackSince.IsZero() {
+        t.failbackSince = now
+        t.events.Add("failback", fmt.Sprintf("%s is synced, failing back to it if it stays that way for %s", sub, policy.stable()))
+        return false
+    }
+    if now.Sub(t.failbackSince) < policy.stable() || !policy.allowed(now) || len(t.damped(now)) > 0 { return false }
+
+    t.events.Add("failback", fmt.Sprintf("Failing back to %s", sub))
+    t.failbackSince = time.Time{}
+    if err := t.gracefulSwitch(policy.timeout()); err != nil {
+        t.alert("failback", fmt.Sprintf("Failback to %s failed, will try again once it's stable :: %s", sub, err.Error()))
+        return false
+    }
+    t.recordSwitch(now)
+    return true
+}
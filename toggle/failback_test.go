@@ -0,0 +1,73 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestFailbackAuto (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Failback = failback_t{ Mode: failbackAuto, Stable: 60 }
+    network.Server(testMain, 6379).SetDown(true)
+    if !tasks.Check() { t.Fatal("Check didn't switch with the main down") }
+
+    network.Server(testMain, 6379).SetDown(false)
+    waitForRole(t, network.Server(testMain, 6379), testSub, 6379)
+    if tasks.Check() { t.Fatal("Failed back as soon as it was up") }   //marks it up again
+
+    now := time.Now()
+    if tasks.checkFailback(now) || tasks.checkFailback(now.Add(time.Second * 30)) { t.Fatal("Failed back before it was stable") }
+    if !tasks.checkFailback(now.Add(time.Minute)) { t.Fatalf("Didn't fail back once it was stable: %+v", tasks.History()) }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Config wasn't swapped back: main %s", tasks.Config.Main.PublicIP) }
+    if !hasCall(network.Server(testMain, 6379), "SLAVEOF no one") { t.Fatal("Old main wasn't promoted again") }
+
+    if tasks.checkFailback(now.Add(time.Hour)) { t.Fatal("Failed back again from the preferred server") }
+}
+
+func TestFailbackBehind (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Failback = failback_t{ Mode: failbackAuto, Stable: 1, MaxLagBytes: 100, Timeout: 1 }
+    tasks.Config.Subordinate.Priority = 1   //prefers the subordinate without needing a failover first
+    network.Server(testMain, 6379).SetOffset(1000)
+    if tasks.Check() { t.Fatal("Failed back to a subordinate that's too far behind") }
+
+    now := time.Now()
+    for i := 0; i < 3; i++ {
+        if tasks.checkFailback(now.Add(time.Minute * time.Duration(i))) { t.Fatal("Failed back to a subordinate that's too far behind") }
+    }
+
+    //close enough to start, but the graceful switch still needs it to catch up all the way
+    network.Server(testSub, 6379).SetOffset(950)
+    if tasks.checkFailback(now) || tasks.checkFailback(now.Add(time.Minute)) { t.Fatal("Failed back without catching up") }
+    if !hasEvent(tasks, "abort") { t.Fatalf("Graceful switch wasn't aborted: %+v", tasks.History()) }
+
+    network.Server(testSub, 6379).SetOffset(1000)
+    tasks.checkFailback(now)
+    if !tasks.checkFailback(now.Add(time.Minute)) { t.Fatalf("Didn't fail back once it caught up: %+v", tasks.History()) }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Config wasn't swapped: main %s", tasks.Config.Main.PublicIP) }
+}
+
+func TestFailbackRise (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.Failback = failback_t{ Mode: failbackAuto, Stable: 60 }
+    tasks.Config.Detection = detection_t{ Rise: 3 }
+    network.Server(testMain, 6379).SetDown(true)
+    if !tasks.Check() { t.Fatal("Check didn't switch with the main down") }
+
+    network.Server(testMain, 6379).SetDown(false)
+    waitForRole(t, network.Server(testMain, 6379), testSub, 6379)
+    for i := 1; i <= 3; i++ {   //it needs rise good checks before it counts as up, the failback doesn't get to check it again
+        tasks.Check()
+        if started := !tasks.failbackSince.IsZero(); started != (i == 3) { t.Fatalf("After %d checks the failback clock started is %v", i, started) }
+    }
+}
+
+func TestFailbackWindow (t *testing.T) {
+    f := failback_t{ Mode: failbackWindow, Window: "23:00-02:00" }
+    if len(f.validate()) > 0 { t.Fatal(f.validate()) }
+    day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+    for hour, want := range map[int]bool{ 22: false, 23: true, 1: true, 2: false, 12: false } {
+        if got := f.allowed(day.Add(time.Hour * time.Duration(hour))); got != want { t.Fatalf("Allowed at %d:00 was %t", hour, got) }
+    }
+    if len(failback_t{ Mode: failbackWindow, Window: "2am" }.validate()) != 1 { t.Fatal("Bad window was accepted") }
+}
@@ -0,0 +1,191 @@
+/*! \file journal.go
+    \brief Switches as transactions, so one that fails part way never leaves the ports split between the servers
+
+    A switch has two steps
+        promote - the subordinate is made the main on each port in turn, if one won't go after a few tries every port
+                  we did promote is pointed back at the old main, so everything's where nginx and our config say it is
+        commit  - every port is promoted, so nginx is pointed at the new main, the old main is demoted and the config swapped
+    Before each step, and after each port is promoted, the switch is written to the journal file.  If we crash part way
+    the journal is replayed at startup, a switch that was still promoting is rolled back and one that was committing is
+    finished off.  The file's removed once a switch is done either way, there's no journal when tasks_c.Journal is empty.
+*/
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/store"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    stepPromote     = "promote"
+    stepCommit      = "commit"
+
+    promoteAttempts = 3     //tries at promoting each port before we roll back
+)
+
+var promoteRetry = time.Second     //between tries, a var so tests can shorten it
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//a switch in progress, as it's written to the journal file
+type journal_t struct {
+    Kind        string      `json:"kind"`      //switch or graceful switch
+    Started     time.Time   `json:"started"`
+    From        server_t    `json:"from"`      //the main we're switching away from
+    To          server_t    `json:"to"`
+    Ports       []int       `json:"ports"`
+    Promoted    []int       `json:"promoted"`  //ports the new main has taken over so far
+    Step        string      `json:"step"`
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Starts a journal for switching from our main to our subordinate
+    The switch is claimed in the state store first, so if another toggle host has changed it since our last check we leave it
+    to them rather than both switching.  Any other trouble with the store doesn't stop us, it shouldn't hold up a failover
+*/
+func (t *tasks_c) beginSwitch (kind string) (*journal_t, error) {
+    if t.Plan == nil {  //a dry run records the save once the switch is done
+        if err := t.storeState(t.Config.Subordinate, t.Config.Main); err == store.ErrStale {
+            return nil, fmt.Errorf("Another toggle host changed the state since our last check, leaving the %s to them", kind)
+        }
+    }
+
+    j := &journal_t{ Kind: kind, Started: time.Now(), From: t.Config.Main, To: t.Config.Subordinate,
+        Ports: append([]int{}, t.Config.Ports...), Step: stepPromote }
+    t.writeJournal(j)
+    return j, nil
+}
+
+/*! \brief Puts our main back in the state store after a switch we claimed there didn't happen
+    Only if it still has the switch, anything else is another toggle host's
+*/
+func (t *tasks_c) unclaimState (j *journal_t) {
+    if t.Store == nil || t.Plan != nil { return }
+    state, err := t.Store.Load()
+    if err != nil || state.Main != j.To.PublicIP || state.Subordinate != j.From.PublicIP { return }
+
+    t.stateVersion = state.Version
+    t.storeState(j.From, j.To)
+}
+
+/*! \brief Records where the switch is up to, a dry run doesn't keep one
+*/
+func (t *tasks_c) writeJournal (j *journal_t) {
+    if len(t.Journal) == 0 || t.Plan != nil { return }
+    byt, err := json.MarshalIndent(j, "", "    ")
+    if err == nil {
+        err = atomicWrite(t.Journal, byt)
+    }
+    if err != nil {
+        t.events.Add("error", fmt.Sprintf("Unable to write the switch journal %s, a crash now can't be recovered from :: %s", t.Journal, err.Error()))
+    }
+}
+
+func (t *tasks_c) clearJournal () {
+    if len(t.Journal) == 0 || t.Plan != nil { return }
+    if err := os.Remove(t.Journal); err != nil && !os.IsNotExist(err) {
+        t.events.Add("error", fmt.Sprintf("Unable to remove the switch journal %s :: %s", t.Journal, err.Error()))
+    }
+}
+
+/*! \brief Returns the switch that was in progress, nil if there wasn't one
+*/
+func readJournal (fileLoc string) (*journal_t, error) {
+    byt, err := ioutil.ReadFile(fileLoc)
+    if os.IsNotExist(err) { return nil, nil }
+    if err != nil { return nil, err }
+
+    j := &journal_t{}
+    if err = json.Unmarshal(byt, j); err != nil {
+        return nil, fmt.Errorf("Switch journal %s is corrupt :: %s", fileLoc, err.Error())
+    }
+    return j, nil
+}
+
+/*! \brief Makes the server the main on this port, trying a few times before giving up
+*/
+func (t *tasks_c) promote (host string, port int) (err error) {
+    t.demoter.cancel(host, port)   //in case it's an old main we're still trying to demote
+    for i := 0; i < promoteAttempts; i++ {
+        if i > 0 { time.Sleep(promoteRetry) }
+        if err = t.subordinateof(host, port, "no", "one"); err == nil { return nil }    //special no one for indicating it's a main
+    }
+    return
+}
+
+/*! \brief Points the ports passed in back at the old main, returns the first thing that went wrong
+*/
+func (t *tasks_c) rollback (j *journal_t, ports []int) (err error) {
+    for _, port := range ports {
+        if rerr := t.subordinateof(j.To.PublicIP, port, j.From.PrivateIP, fmt.Sprintf("%d", port)); rerr != nil && err == nil {
+            err = rerr
+        }
+    }
+    return
+}
+
+/*! \brief Finishes off a switch once every port is promoted, swapping our config if it hasn't been already
+*/
+func (t *tasks_c) commit (j *journal_t) {
+    j.Step = stepCommit
+    t.writeJournal(j)
+
+    t.updateNginx(j.To.PublicIP)
+    for _, port := range j.Ports {
+        //now we need to keep trying to talk to the main server and to let it know it's no longer the main
+        t.mainToSubordinate(j.From.PublicIP, j.To.PrivateIP, port)
+    }
+    if t.Config.Main.PublicIP == j.From.PublicIP {
+        t.swapServers() //switch the values so we know which is the main and which is the subordinate now
+    }
+    t.clearJournal()
+}
+
+/*! \brief Rolls back or finishes off a switch we crashed in the middle of, call this before looking at the servers at startup
+    Returns true if the main and subordinate were swapped and the config file needs to be written
+*/
+func (t *tasks_c) replayJournal () (swapped bool) {
+    if len(t.Journal) == 0 { return false }
+    j, err := readJournal(t.Journal)
+    if err != nil {
+        t.alert("error", err.Error() + ", leaving it for someone to look at")
+        return false
+    }
+    if j == nil { return false }
+
+    if j.Step == stepCommit {
+        t.events.Add("journal", fmt.Sprintf("Finishing the %s to %s started at %s", j.Kind, j.To.PublicIP, j.Started.Format("2006-01-02 15:04:05")))
+        swapped = t.Config.Main.PublicIP == j.From.PublicIP
+        t.commit(j)
+        return
+    }
+
+    //we could have promoted a port without getting to record it, so every port goes back
+    t.events.Add("journal", fmt.Sprintf("Rolling back the %s to %s started at %s", j.Kind, j.To.PublicIP, j.Started.Format("2006-01-02 15:04:05")))
+    if err := t.rollback(j, j.Ports); err != nil {
+        t.alert("error", fmt.Sprintf("Unable to roll back every port to %s :: %s", j.From.PublicIP, err.Error()))
+    }
+    t.unclaimState(j)
+    if j.Kind == "graceful switch" {    //it paused writes on the old main, redis lifts that on its own eventually but there's no need to wait
+        for _, port := range j.Ports {
+            if r, err := t.connect(j.From.PublicIP, port); err == nil { r.Unpause() }
+        }
+    }
+    t.clearJournal()
+    return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+func TestReplayJournalCommit (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    tasks.Config.Main.Priority = 5     //make sure the config comes back whole
+    j := &journal_t{ Kind: "switch", From: tasks.Config.Main, To: tasks.Config.Subordinate, Ports: []int{ 6379, 6380 }, Promoted: []int{ 6379, 6380 }, Step: stepCommit }
+    tasks.writeJournal(j)
+    for _, port := range []int{ 6379, 6380 } {  //we crashed after promoting, before demoting the old main
+        network.Server(testSub, port).SetRole(redis.Role_t{ Main: true })
+    }
+
+    if !tasks.ValidateConfig() { t.Fatal("Config wasn't swapped by the replay") }
+    if tasks.Config.Main.PublicIP != testSub || tasks.Config.Subordinate.Priority != 5 { t.Fatalf("Switch wasn't finished: %+v", tasks.Config) }
+    for _, port := range []int{ 6379, 6380 } {
+        if role := network.Server(testMain, port).Role(); role.Main || role.MainHost != testSub { t.Fatalf("Old main on %d wasn't demoted: %+v", port, role) }
+    }
+    if !hasEvent(tasks, "journal") { t.Fatalf("Missing journal event: %+v", tasks.History()) }
+    if j, _ := readJournal(tasks.Journal); j != nil { t.Fatal("Journal was left behind") }
+}
+
+func TestReplayJournalRollback (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    j := &journal_t{ Kind: "graceful switch", From: tasks.Config.Main, To: tasks.Config.Subordinate, Ports: []int{ 6379, 6380 }, Promoted: []int{ 6379 }, Step: stepPromote }
+    tasks.writeJournal(j)
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true })  //promoted before we crashed
+    if c, err := network.Dial(testMain, 6379, redis.Timeouts_t{}); err == nil { c.PauseWrites(time.Minute) }
+
+    tasks.ValidateConfig()
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if role := network.Server(testSub, 6379).Role(); role.Main || role.MainHost != testMain { t.Fatalf("Promoted port wasn't rolled back: %+v", role) }
+    if network.Server(testMain, 6379).Paused() { t.Fatal("Old main was left paused") }
+    if j, _ := readJournal(tasks.Journal); j != nil { t.Fatal("Journal was left behind") }
+}
@@ -12,7 +12,10 @@
 
     do a 
     kill -10 pid
-    to cause this to switch between the main and subordinate
+    to cause this to switch between the main and subordinate, this is a graceful switch that waits for the subordinate to catch up
+    and a
+    kill -HUP pid
+    to reload the config file without restarting
 
 *   2017-09-15 NT   Created
     2017-12-29 NT   Modified so there's a main who can be return a json of the current setup to a request
@@ -30,7 +33,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -39,10 +42,7 @@ import (
 	"sync"
 	"syscall"
 	"time"
-    "io/ioutil"
     "net/http"
-
-    "github.com/NathanRThomas/redisToggle/nginx"
 )
 
 const API_VER = "0.2.1"
@@ -52,47 +52,19 @@ var appConfig appConfig_t //create an instance of our app config
 //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-func loadConfig (config *appConfig_t, fileLoc string) {
-    configFile, err := os.Open(fileLoc) //try the file
-
-    if err == nil {
-        jsonParser := json.NewDecoder(configFile)
-        err = jsonParser.Decode(config)
-    }
-    
-    if err != nil {
-        log.Fatalln(err)    //we can't move forward from here no matter what
+/*! \brief Re-reads the config file and applies any changes to the running tasks
+*/
+func reloadConfig (tasks *tasks_c, fileLoc string) error {
+    var config appConfig_t
+    if err := loadConfig(&config, fileLoc); err != nil {
+        return fmt.Errorf("Unable to reload %s :: %s", fileLoc, err.Error())
     }
 
-    //validate the file makes sense
-    //validate each redis server config, we'll actually try to resolve them later
-    if len(config.Main.PublicIP) < 1 { config.Main.PublicIP = config.Main.PrivateIP}
-    if len(config.Subordinate.PublicIP) < 1 { config.Subordinate.PublicIP = config.Subordinate.PrivateIP}
-    if len(config.Main.PrivateIP) < 1 { config.Main.PrivateIP = config.Main.PublicIP}
-    if len(config.Subordinate.PrivateIP) < 1 { config.Subordinate.PrivateIP = config.Subordinate.PublicIP}
-
-    if len(config.Main.PublicIP) < 7 { //not a real ip check, but we need something to verify it looks good
-        log.Fatalln("Main ip from redis server appears invalid")
-    }
-    if len(config.Subordinate.PublicIP) < 7 { //not a real ip check, but we need something to verify it looks good
-        log.Fatalln("Subordinate ip from redis server index appears invalid")
+    rewrite, err := tasks.Reload(config)
+    if err == nil && rewrite {  //we kept our current main rather than what the file said, so fix the file
+        tasks.WriteConfig(fileLoc)
     }
-    if len(config.Ports) < 1 {
-        log.Fatalln("No ports are setup in the config")
-    }
-}
-
-func writeConfig (config *appConfig_t, fileLoc string) {
-    fmt.Println("writing new config")
-    byt, _ := json.Marshal(*config)
-    err := ioutil.WriteFile(fileLoc, byt, 0666)
-    if err != nil { log.Println(err) }
-}
-
-func mainEndpoint(w http.ResponseWriter, r *http.Request) {
-    if r.Method == "OPTIONS" { return } //this is a "test" request sent by javascript to test if the call is valid, or something, so just ignore it
-    js, _ := json.Marshal(appConfig)
-    w.Write(js)
+    return err
 }
 
 
@@ -102,17 +74,30 @@ func mainEndpoint(w http.ResponseWriter, r *http.Request) {
 
 func main() {
     log.SetFlags(log.LstdFlags | log.Lshortfile) //configure the logging for this application
+
+    if runCommand(os.Args[1:]) { return }   //we were asked to run a subcommand against a running toggle instead
 	
 	versionFlag := flag.Bool("v", false, "Returns the version")
 	intervalFlag := flag.Int("i", 2, "Interval in seconds to check if the main is alive")
     retryFlag := flag.Int("r", 2, "Interval in seconds to double check if the main is alive")
-    configFlag := flag.String("c", "toggle.conf", "Location of the config file")
+    configFlag := flag.String("c", "toggle.conf", "Location of the config file. Subordinates keep the last config they applied here")
     portFlag := flag.Int("p", 0, "Port for this main to return the current status. Also makes this act as a main")
     subordinateFlag := flag.Bool("subordinate", false, "Makes this instance run as a subordinate, only polls for changes, won't make them")
-    mainIPFlag := flag.String("main", "", "ip address of the main toggle service we're going to ask the settings of")
+    mainIPFlag := flag.String("main", "", "Comma separated ip or ip:port addresses of the main toggle services we're going to ask the settings of, in order of preference")
+    independentFlag := flag.Int("independent", 0, "Seconds a subordinate can go without reaching a main toggle before it checks redis and fails over on its own, 0 disables")
+    gracefulFlag := flag.Int("graceful", 10, "Seconds a planned switch (signal or admin api) has to sync the subordinate before it gives up and unpauses the main")
+    backupsFlag := flag.Int("backups", configBackups, "Number of timestamped backups of the config file to keep when it's rewritten, 0 disables")
+    tokenFlag := flag.String("token", "", "Bearer token required by the admin api (/switch, /pause, /resume, /status). The admin api is disabled without it. Subordinates send it to their mains to be given the state backend")
+    nginxDirFlag := flag.String("nginx-dir", "", "Directory nginx keeps its config in, defaults to /etc/nginx")
+    nginxReloadFlag := flag.String("nginx-reload", "", "Shell command to reload nginx with, defaults to systemctl reload nginx")
+    chaosFlag := flag.Bool("chaos", false, "Allows faults to be injected through the admin api (/chaos) for failover drills, never leave this on in production")
+    shutdownFlag := flag.Int("shutdown", 30, "Seconds we wait on stopping for a switch in progress to finish or roll back before giving up on it")
+    journalFlag := flag.String("journal", "", "File a switch in progress is recorded in, so it can be finished or rolled back after a crash. Defaults to the config file with .journal on the end")
+    dryRunFlag := flag.Bool("dry-run", false, "Checks the servers as usual but only prints what it would change, nothing is written to redis, nginx, the config or the state store")
     testFlag := flag.Bool("testing", false, "Creates the configs and writes to the log, but doesn't actually change anything.  Used for testing")
 	
 	flag.Parse()
+    configBackups = *backupsFlag
 
 	if *versionFlag {
 		fmt.Printf("\nToggle Version: %s\n\n", API_VER)
@@ -121,6 +106,10 @@ func main() {
         log.Fatalf("Interval time is invalid, must be greater than 0: %d\n", *intervalFlag)
     } else if *retryFlag < 1 {
         log.Fatalf("retry time is invalid, must be greater than 0: %d\n", *intervalFlag)
+    } else if *gracefulFlag < 1 {
+        log.Fatalf("graceful time is invalid, must be greater than 0: %d\n", *gracefulFlag)
+    } else if *shutdownFlag < 1 {
+        log.Fatalf("shutdown time is invalid, must be greater than 0: %d\n", *shutdownFlag)
     }
 
     defer log.Println("Toggle Toggle MuthaF*cker")
@@ -129,10 +118,11 @@ func main() {
     
     //signals for quitting
     c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+    signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
     //tickers for the tasks scheduled at intervals
     ticker := time.NewTicker(time.Second * time.Duration(*intervalFlag))    //used for the main as well as the subordinate
+    ctx, cancel := context.WithCancel(context.Background())  //cancelled when we're stopping, so nothing new gets started
     
     go func() { //handle exiting
         <-c
@@ -140,6 +130,7 @@ func main() {
         // sig is a ^C, handle it
         log.Println("Toggle stopping")
 
+        cancel()
         ticker.Stop()   //this kills the above thread loop
         wg.Done()   //if we're here it's cause the ticker is no more
         //}
@@ -147,38 +138,45 @@ func main() {
 
     if *subordinateFlag {  //we're running as a subordinate, this is different.  
         //We only poll the other server for the current main and copy the settings here
-        if *portFlag == 0 { log.Fatalln("Subordinate must have -p= set to the port the main is running on") }
-        if len(*mainIPFlag) < 7 { log.Fatalln("Main ip [--main=] appears invalid") }
+        sub := subordinate_c{ Independent: *independentFlag, Retry: *retryFlag, TestingFlag: *testFlag, NginxDir: *nginxDirFlag, NginxReload: *nginxReloadFlag, ConfigFile: *configFlag, Token: *tokenFlag, Ctx: ctx }
+        if err := sub.SetMains(*mainIPFlag, *portFlag); err != nil { log.Fatalln(err) }
+        if err := sub.Load(); err != nil { log.Fatalln(err) }
 
         //subordinate task
         go func() {
-            lastIP := ""
-            tasks := tasks_c{}
-            nginx := nginx.Nginx_c{ TestingFlag: *testFlag }
-
             for range ticker.C {  //every time we "tick"
-                config, err := tasks.SubordinateCheck (*mainIPFlag, *portFlag)
-                if err == nil { //otherwise we ignore this
-                    if lastIP != config.Main.PrivateIP {  //we've had a switch
-                        log.Printf("Subordinate set config to %s\n", config.Main.PrivateIP)
-                        nginx.Set (config.Main.PrivateIP, config.Ports)    //update nginx to reflect this new setup
-                        lastIP = config.Main.PrivateIP //it changed, so save it
-                    }
-                } else {
-                    log.Println(err)    //we had an error
-                }
+                sub.Tick()
             }
         }()
 
         wg.Wait() //wait here until we get an exit ^C request
+
+        //same as a main toggle below, a failover we're in the middle of gets to finish or roll back
+        shutdownCtx, done := context.WithTimeout(context.Background(), time.Second * time.Duration(*shutdownFlag))
+        if err := sub.Shutdown(shutdownCtx); err != nil { log.Println(err) }
+        done()
         os.Exit(0)  //we're done
 	}
 
-	loadConfig(&appConfig, *configFlag) //load our config file
-    tasks := tasks_c{Config: &appConfig, Retry: *retryFlag, TestingFlag: *testFlag} //this "class" handles the actual work, we just need to call it when it's appropriate
+	if err := loadConfig(&appConfig, *configFlag); err != nil { //load our config file
+        log.Fatalln(err)    //we can't move forward from here no matter what
+    }
+    if len(*journalFlag) == 0 { *journalFlag = *configFlag + ".journal" }
+    tasks := tasks_c{Config: &appConfig, Retry: *retryFlag, TestingFlag: *testFlag, NginxDir: *nginxDirFlag, NginxReload: *nginxReloadFlag, Store: newStore(appConfig.State), Ctx: ctx, Journal: *journalFlag} //this "class" handles the actual work, we just need to call it when it's appropriate
     
     //first we want to validate our config so that tasks can run when we schedule it to
-    tasks.ValidateConfig()  //if we don't throw a fatal, then we can keep going here
+    if *dryRunFlag { tasks.Plan = &plan_c{} }
+
+    //runs one of the tasks, writing the config if it switched, or just printing what it would have done for a dry run
+    run := func (fn func () bool) {
+        if tasks.Plan != nil {
+            tasks.Planned(os.Stdout, *configFlag, fn)
+        } else if fn() {
+            tasks.WriteConfig(*configFlag)
+        }
+    }
+
+    run(tasks.ValidateConfig)   //if we don't throw a fatal, then we can keep going here
 
     //signal for switching main/subordinate
     switchSignal := make(chan os.Signal, 1)
@@ -187,28 +185,55 @@ func main() {
     //main task
 	go func() {
         for range ticker.C {  //every time we "tick"
-            if tasks.Check() {    //main entry point
-                writeConfig (&appConfig, *configFlag)
-            }
+            time.Sleep(tasks.Jitter())  //spread the checks out a little
+            run(tasks.Check)    //main entry point
 		}
 	}()
 
     go func() {
-        <-switchSignal
+        for range switchSignal {   //every time we get the signal
+            log.Println("Graceful switch due to signal")
+            run(func () bool { return tasks.GracefulSwitch(time.Second * time.Duration(*gracefulFlag)) == nil })
+        }
+    }()
 
-        log.Println("Switching due to signal")
-        if tasks.Switch() {
-            writeConfig (&appConfig, *configFlag)
+    //signal for reloading the config file
+    reloadSignal := make(chan os.Signal, 1)
+    signal.Notify(reloadSignal, syscall.SIGHUP)
+
+    go func() {
+        for range reloadSignal {
+            log.Println("Reloading config due to signal")
+            if err := reloadConfig(&tasks, *configFlag); err != nil {
+                log.Println(err)
+            }
         }
     }()
 
+    var server *http.Server
     if *portFlag > 0 {
+        mux := http.NewServeMux()
+        api := api_c{ Tasks: &tasks, Token: *tokenFlag, ConfigFile: *configFlag, Graceful: time.Second * time.Duration(*gracefulFlag), Chaos: *chaosFlag }
+        api.Register(mux)
+        server = &http.Server{ Addr: fmt.Sprintf(":%d", *portFlag), Handler: mux }
+
         go func() {
             log.Println("Toggle running as main on port : ", *portFlag)
-            http.HandleFunc("/", mainEndpoint)
-            http.ListenAndServe(fmt.Sprintf(":%d", *portFlag), nil)
+            if err := server.ListenAndServe(); err != http.ErrServerClosed {
+                log.Println(err)
+            }
         }()
     }
 	
 	wg.Wait() //wait here until we get an exit ^C request
+
+    //give anything in progress, including admin requests, a chance to finish before we save everything
+    shutdownCtx, done := context.WithTimeout(context.Background(), time.Second * time.Duration(*shutdownFlag))
+    defer done()
+    if server != nil {
+        if err := server.Shutdown(shutdownCtx); err != nil { log.Println(err) }
+    }
+    if err := tasks.Shutdown(shutdownCtx, *configFlag); err != nil {
+        log.Println(err)
+    }
 }
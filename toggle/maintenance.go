@@ -0,0 +1,160 @@
+/*! \file maintenance.go
+    \brief Planned switchovers, where both servers are up and we don't want to lose any writes along the way
+
+    Unlike Switch, which assumes the main is dead, this pauses writes on the main, waits for the subordinate to catch up,
+    promotes it, points nginx at it and only then demotes the old main.  If anything goes wrong before the promotion is
+    done we unpause and leave everything the way it was.
+*/
+
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const syncPollInterval = time.Millisecond * 100    //how often we check the subordinate's offset while waiting for it to catch up
+
+//the main stays paused this much longer than the sync timeout, so there's time to claim, promote and point nginx at the new main
+//after the subordinate catches up at the last moment.  If less than commitMargin of it is left once we're promoted we roll back
+var switchMargin = time.Second * 10
+var commitMargin = time.Second * 3
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type switchPair_t struct {
+    port        int
+    main, sub   redis.Client_i
+    paused      bool
+    promoted    bool
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Waits until the subordinate has everything the main had when we paused it
+*/
+func (t *tasks_c) waitForSync (p *switchPair_t, deadline time.Time) error {
+    target, err := p.main.Offset()  //writes are paused, so this won't move
+    if err != nil {
+        return fmt.Errorf("Unable to get replication offset from main on port %d :: %s", p.port, err.Error())
+    }
+
+    for {
+        offset, err := p.sub.Offset()
+        if err == nil && offset >= target { return nil }  //caught up
+
+        if time.Now().After(deadline) {
+            if err != nil { return fmt.Errorf("Subordinate on port %d never caught up :: %s", p.port, err.Error()) }
+            return fmt.Errorf("Subordinate on port %d never caught up, at %d of %d", p.port, offset, target)
+        }
+        select {
+        case <-t.done():
+            return fmt.Errorf("Shutting down before the subordinate on port %d caught up", p.port)
+        case <-time.After(syncPollInterval):
+        }
+    }
+}
+
+/*! \brief Does the actual graceful switch, callers need to be holding t.lock
+*/
+func (t *tasks_c) gracefulSwitch (timeout time.Duration) (err error) {
+    if t.stopping() { return fmt.Errorf("Shutting down") }
+    t.status.Begin("graceful switch")
+    defer t.status.End()
+
+    deadline := time.Now().Add(timeout)
+    main, sub := t.Config.Main, t.Config.Subordinate
+    pairs := make([]*switchPair_t, 0, len(t.Config.Ports))
+    var j *journal_t
+
+    defer func() {  //clean up after ourselves, if we failed this puts things back the way they were
+        for _, p := range pairs {
+            if err != nil && p.promoted {
+                t.subordinateof(sub.PublicIP, p.port, main.PrivateIP, fmt.Sprintf("%d", p.port))
+            }
+            if p.paused { p.main.Unpause() }
+        }
+        if j != nil {
+            if err != nil { t.unclaimState(j) }
+            t.clearJournal()
+        }
+        if err != nil {
+            t.events.Add("abort", fmt.Sprintf("Graceful switch to %s aborted :: %s", sub.PublicIP, err.Error()))
+        }
+    }()
+
+    for _, port := range t.Config.Ports {
+        p := &switchPair_t{ port: port }
+        if p.main, err = t.connect(main.PublicIP, port); err != nil { return }
+        if p.sub, err = t.connect(sub.PublicIP, port); err != nil { return }
+        pairs = append(pairs, p)
+    }
+
+    //stop writes on every main first, redis will lift these on its own once the timeout is up in case we never get back to it
+    pausedUntil := time.Now().Add(timeout + switchMargin)  //taken before the first pause, so it's never later than any of them
+    for _, p := range pairs {
+        if err = p.main.PauseWrites(timeout + switchMargin); err != nil { return }
+        p.paused = true
+    }
+
+    for _, p := range pairs {
+        if err = t.waitForSync(p, deadline); err != nil { return }
+    }
+
+    if time.Now().After(deadline) { //don't start promoting if the pause is about to expire on us
+        err = fmt.Errorf("Timed out after %s", timeout)
+        return
+    }
+
+    if j, err = t.beginSwitch("graceful switch"); err != nil { return }    //so a crash from here on is rolled back or finished at startup, see journal.go
+    for _, p := range pairs {
+        t.demoter.cancel(sub.PublicIP, p.port)  //in case it's an old main we're still trying to demote
+        if err = p.sub.Subordinateof("no", "one"); err != nil { return }
+        p.promoted = true
+        j.Promoted = append(j.Promoted, p.port)
+        t.writeJournal(j)
+    }
+
+    //a write that lands on the old main after its pause runs out, and before it's demoted, is lost
+    if left := time.Until(pausedUntil); left < commitMargin {
+        err = fmt.Errorf("Only %s left on the pause after promoting, not enough to point nginx at the new main", left.Round(time.Millisecond))
+        return
+    }
+
+    //we're committed now, the old main's still paused while it's demoted
+    t.commit(j)
+    t.failedFrom = ""   //whoever's the main now is where someone wanted it
+
+    t.events.Add("switch", fmt.Sprintf("Graceful switch completed to new main at %s", sub.PublicIP))
+    return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Planned switch to the subordinate without losing any writes, gives up and puts everything back after timeout
+*/
+func (t *tasks_c) GracefulSwitch (timeout time.Duration) error {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    return t.gracefulSwitch(timeout)
+}
+
+/*! \brief Same as GracefulSwitch, except it won't wait if a check or switch is already running
+*/
+func (t *tasks_c) TryGracefulSwitch (timeout time.Duration) (started bool, err error) {
+    if !t.lock.TryLock() { return false, nil }
+    defer t.lock.Unlock()
+    return true, t.gracefulSwitch(timeout)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis/redistest"
+)
+
+func TestGracefulSwitch (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetOffset(100)
+    network.Server(testSub, 6379).SetOffset(100)
+
+    if err := tasks.GracefulSwitch(time.Second); err != nil { t.Fatal(err) }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    main := network.Server(testMain, 6379)
+    if main.Paused() { t.Fatal("Old main was left paused") }
+    waitForRole(t, main, testSub, 6379)
+}
+
+func TestGracefulSwitchNeverSyncs (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetOffset(100)
+    network.Server(testSub, 6379).SetOffset(50)
+
+    err := tasks.GracefulSwitch(time.Millisecond * 300)
+    if err == nil || !strings.Contains(err.Error(), "never caught up") { t.Fatalf("Expected a sync timeout, got %v", err) }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if network.Server(testMain, 6379).Paused() { t.Fatal("Main was left paused") }
+    if network.Server(testSub, 6379).Role().Main { t.Fatal("Subordinate was promoted") }
+    if !hasEvent(tasks, "abort") { t.Fatal("No abort event") }
+}
+
+//the subordinate catches up close to the deadline, after 250ms of 400, which leaves a poll or so to spare
+func lateSync (network *redistest.FakeNetwork_c) {
+    network.Server(testMain, 6379).SetOffset(100)
+    network.Server(testSub, 6379).SetOffset(50)
+    go func () {
+        time.Sleep(time.Millisecond * 250)
+        network.Server(testSub, 6379).SetOffset(100)
+    }()
+}
+
+func TestGracefulSwitchLateSync (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    lateSync(network)
+
+    if err := tasks.GracefulSwitch(time.Millisecond * 400); err != nil { t.Fatal(err) }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    pause := fmt.Sprintf("CLIENT PAUSE %d WRITE", int64((time.Millisecond * 400 + switchMargin) / time.Millisecond))
+    if !hasCall(network.Server(testMain, 6379), pause) { t.Fatalf("Main wasn't paused past the deadline: %v", network.Server(testMain, 6379).Calls()) }
+}
+
+func TestGracefulSwitchPauseRunsOut (t *testing.T) {
+    defer func (s, c time.Duration) { switchMargin, commitMargin = s, c }(switchMargin, commitMargin)
+    switchMargin, commitMargin = 0, time.Second  //the pause ends with the deadline, which can't cover the commit
+    tasks, network := newTestTasks(t, 6379)
+    lateSync(network)
+
+    err := tasks.GracefulSwitch(time.Millisecond * 400)
+    if err == nil || !strings.Contains(err.Error(), "left on the pause") { t.Fatalf("Expected the switch to stop before committing, got %v", err) }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if role := network.Server(testSub, 6379).Role(); role.Main || role.MainHost != testMain { t.Fatalf("Promotion wasn't rolled back: %+v", role) }
+    if network.Server(testMain, 6379).Paused() { t.Fatal("Main was left paused") }
+}
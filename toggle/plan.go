@@ -0,0 +1,210 @@
+/*! \file plan.go
+    \brief Dry runs, everything toggle would have done is recorded as a plan instead of being done
+
+    While tasks_c.Plan is set we still connect to the redis servers and read from them, but every command that would
+    change one, the nginx file, the config file, the state store and any alert webhooks are only recorded.
+*/
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/nginx"
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+//one thing we would have done
+type action_t struct {
+    Kind        string  `json:"kind"`      //redis, nginx, config, state or hook
+    Target      string  `json:"target"`
+    Detail      string  `json:"detail"`
+}
+
+type plan_c struct {
+    lock        sync.Mutex
+    actions     []action_t
+}
+
+//everything a dry run can change besides the plan, so Planned can put it back and the next run starts from the same place
+type planSnapshot_t struct {
+    config          appConfig_t
+    nginxIP         string
+    failedFrom      string
+    failbackSince   time.Time
+    switches        []time.Time
+    splitBrain      bool
+    replicating     bool
+    paused          bool
+}
+
+//passes reads through to the real server and records anything that would change it
+type planClient_c struct {
+    redis.Client_i
+    plan        *plan_c
+    target      string
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (p *plan_c) add (kind, target, format string, args ...interface{}) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    p.actions = append(p.actions, action_t{ Kind: kind, Target: target, Detail: fmt.Sprintf(format, args...) })
+}
+
+/*! \brief Records the change to the nginx file if we rendered it for this ip
+*/
+func (p *plan_c) nginx (n *nginx.Nginx_c, ip string, ports []int) {
+    content, err := n.Render(ip, ports)
+    if err != nil {
+        p.add("nginx", n.File(), "Unable to render :: %s", err.Error())
+        return
+    }
+    current, _ := ioutil.ReadFile(n.File())   //missing is the same as empty
+    if diff := lineDiff(string(current), content); len(diff) > 0 {
+        p.add("nginx", n.File(), "write and reload\n%s", strings.Join(diff, "\n"))
+    }
+}
+
+/*! \brief Records the change to the config file if we wrote this config to it
+*/
+func (p *plan_c) config (fileLoc string, config appConfig_t) {
+    byt, err := encodeConfig(&config, configFormat(fileLoc))
+    if err != nil {
+        p.add("config", fileLoc, "Unable to encode :: %s", err.Error())
+        return
+    }
+    current, _ := ioutil.ReadFile(fileLoc)
+    if diff := lineDiff(string(current), string(byt)); len(diff) > 0 {
+        p.add("config", fileLoc, "back up and write\n%s", strings.Join(diff, "\n"))
+    }
+}
+
+/*! \brief Returns the lines that changed between the two, prefixed with - and +, empty if they're the same
+*/
+func lineDiff (before, after string) (ret []string) {
+    if before == after { return nil }
+    a, b := strings.Split(strings.TrimRight(before, "\n"), "\n"), strings.Split(strings.TrimRight(after, "\n"), "\n")
+    if len(before) == 0 { a = nil }
+
+    //longest common subsequence, the files are small enough not to worry about doing better
+    lcs := make([][]int, len(a) + 1)
+    for i := range lcs { lcs[i] = make([]int, len(b) + 1) }
+    for i := len(a) - 1; i >= 0; i-- {
+        for j := len(b) - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+
+    i, j := 0, 0
+    for i < len(a) || j < len(b) {
+        switch {
+        case i < len(a) && j < len(b) && a[i] == b[j]:
+            i++
+            j++
+        case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+            ret = append(ret, "- " + a[i])
+            i++
+        default:
+            ret = append(ret, "+ " + b[j])
+            j++
+        }
+    }
+    return
+}
+
+func (c *planClient_c) Health (mainFlag bool, profile redis.Profile_t) redis.Health_t {
+    return c.Client_i.Health(false, profile)    //checking the main writes to it, so we only do the read-only checks
+}
+
+func (c *planClient_c) Subordinateof (ip, port string) error {
+    c.plan.add("redis", c.target, "SLAVEOF %s %s", ip, port)
+    return nil
+}
+
+func (c *planClient_c) PauseWrites (d time.Duration) error {
+    c.plan.add("redis", c.target, "CLIENT PAUSE %d WRITE", int64(d / time.Millisecond))
+    return nil
+}
+
+func (c *planClient_c) Unpause () error {
+    c.plan.add("redis", c.target, "CLIENT UNPAUSE")
+    return nil
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns everything recorded so far and starts a new plan
+*/
+func (p *plan_c) Reset () []action_t {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    ret := p.actions
+    p.actions = nil
+    return ret
+}
+
+/*! \brief Prints the actions as a numbered list
+*/
+func printPlan (w io.Writer, actions []action_t) {
+    if len(actions) == 0 {
+        fmt.Fprintln(w, "Nothing to do")
+        return
+    }
+    for i, a := range actions {
+        fmt.Fprintf(w, "%d. [%s] %s: %s\n", i + 1, a.Kind, a.Target, strings.Replace(a.Detail, "\n", "\n    ", -1))
+    }
+}
+
+func (t *tasks_c) snapshot () planSnapshot_t {
+    return planSnapshot_t{ config: t.CurrentConfig(), nginxIP: t.nginxIP, failedFrom: t.failedFrom, failbackSince: t.failbackSince,
+        switches: append([]time.Time{}, t.switches...), splitBrain: t.splitBrain, replicating: t.replicating, paused: t.status.Paused() }
+}
+
+func (t *tasks_c) restore (snap planSnapshot_t) {
+    t.cfgLock.Lock()
+    *t.Config = snap.config
+    t.cfgLock.Unlock()
+    t.nginxIP, t.failedFrom, t.failbackSince = snap.nginxIP, snap.failedFrom, snap.failbackSince
+    t.switches, t.splitBrain, t.replicating = snap.switches, snap.splitBrain, snap.replicating
+    t.status.SetPaused(snap.paused)
+}
+
+/*! \brief Runs fn as a dry run, printing the plan and then putting everything it changed back the way it was
+    fileLoc is where the config would have been written if fn returns true
+*/
+func (t *tasks_c) Planned (w io.Writer, fileLoc string, fn func () bool) []action_t {
+    before := t.snapshot()
+    if fn() {
+        t.WriteConfig(fileLoc)
+    }
+
+    actions := t.Plan.Reset()
+    if len(actions) > 0 {
+        fmt.Fprintf(w, "Plan at %s\n", time.Now().Format("2006-01-02 15:04:05"))
+        printPlan(w, actions)
+    }
+
+    t.restore(before)   //nothing really changed, so neither should we
+    return actions
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "io/ioutil"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestPlanSwitch (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Plan = &plan_c{}
+    tasks.Config.Alerts.Webhook = "http://127.0.0.1:1/alerts"
+    tasks.applySettings()
+
+    actions := tasks.Planned(ioutil.Discard, t.TempDir() + "/toggle.conf", tasks.Switch)
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Config wasn't put back, main is %s", tasks.Config.Main.PublicIP) }
+    for _, port := range []int{ 6379 } {
+        if calls := network.Server(testSub, port).Calls(); len(calls) > 0 { t.Fatalf("Subordinate was changed in a dry run: %v", calls) }
+        if calls := network.Server(testMain, port).Calls(); len(calls) > 0 { t.Fatalf("Main was changed in a dry run: %v", calls) }
+    }
+
+    want := map[string]bool{ "redis " + testSub + ":6379 SLAVEOF no one": false, "redis " + testMain + ":6379 SLAVEOF " + testSub + " 6379": false }
+    kinds := make(map[string]bool)
+    for _, a := range actions {
+        kinds[a.Kind] = true
+        if _, ok := want[a.Kind + " " + a.Target + " " + a.Detail]; ok { want[a.Kind + " " + a.Target + " " + a.Detail] = true }
+    }
+    for action, seen := range want {
+        if !seen { t.Fatalf("Plan is missing %q: %+v", action, actions) }
+    }
+    for _, kind := range []string{ "nginx", "config" } {
+        if !kinds[kind] { t.Fatalf("Plan has no %s change: %+v", kind, actions) }
+    }
+}
+
+func TestPlanRepeated (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Plan = &plan_c{}
+    tasks.Config.Damping.MaxPerHour = 2
+    tasks.Config.Failback = failback_t{ Mode: failbackAuto }
+    tasks.Config.Main.Priority = 5
+    tasks.applySettings()
+    network.Server(testMain, 6379).SetDown(true)
+
+    before := tasks.snapshot()
+    for i := 0; i < 4; i++ {    //a dry run ticking away with the main down
+        actions := tasks.Planned(ioutil.Discard, t.TempDir() + "/toggle.conf", tasks.Check)
+        if i > 0 && len(actions) == 0 { t.Fatalf("Run %d planned nothing, the last run's failover stuck", i + 1) }
+        if after := tasks.snapshot(); !reflect.DeepEqual(before, after) { t.Fatalf("Run %d left state behind:\n%+v\n%+v", i + 1, before, after) }
+    }
+    if hasEvent(tasks, "flapping") || tasks.status.Paused() { t.Fatal("Simulated failovers tripped the damping") }
+}
+
+func TestLineDiff (t *testing.T) {
+    diff := lineDiff("a\nb\nc\n", "a\nx\nc\n")
+    if strings.Join(diff, "|") != "- b|+ x" { t.Fatalf("Unexpected diff %q", diff) }
+    if lineDiff("same\n", "same\n") != nil { t.Fatal("Diff of identical files isn't empty") }
+}
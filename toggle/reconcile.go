@@ -0,0 +1,119 @@
+/*! \file reconcile.go
+    \brief Works out the real replication topology from the redis servers themselves
+
+    The config file, or the state store, can be out of date with what the servers are actually doing.  At startup we ask
+    each server what its role is, line our config up with that, and refuse to touch anything if both claim to be the main.
+*/
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type nodeRole_t struct {
+    host        string
+    role        redis.Role_t
+    err         error       //set if we couldn't reach it
+}
+
+type portTopology_t struct {
+    port        int
+    main, sub   nodeRole_t  //as they are in our config
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func (n nodeRole_t) String () string {
+    if n.err != nil { return fmt.Sprintf("%s unreachable (%s)", n.host, n.err.Error()) }
+    if n.role.Main { return fmt.Sprintf("%s main at offset %d", n.host, n.role.Offset) }
+    return fmt.Sprintf("%s subordinate of %s:%d at offset %d", n.host, n.role.MainHost, n.role.MainPort, n.role.Offset)
+}
+
+/*! \brief Asks the server on this port what its role is
+*/
+func (t *tasks_c) nodeRole (host string, port int) (n nodeRole_t) {
+    n.host = host
+    r, err := t.connect(host, port)
+    if err == nil {
+        if n.role, err = r.Role(); err != nil { t.conns.drop(host, port) }
+    }
+    n.err = err
+    t.status.Record(host, port, err)
+    return
+}
+
+/*! \brief Returns the role of both servers on every port
+*/
+func (t *tasks_c) topology () []portTopology_t {
+    ret := make([]portTopology_t, 0, len(t.Config.Ports))
+    for _, port := range t.Config.Ports {
+        ret = append(ret, portTopology_t{ port: port, main: t.nodeRole(t.Config.Main.PublicIP, port), sub: t.nodeRole(t.Config.Subordinate.PublicIP, port) })
+    }
+    return ret
+}
+
+/*! \brief Returns true if the role says it's replicating from the server on this port
+*/
+func (t *tasks_c) replicatesFrom (role redis.Role_t, server server_t, port int) bool {
+    if role.Main || role.MainPort != port { return false }
+
+    for _, host := range []string{ server.PrivateIP, server.PublicIP } {
+        if role.MainHost == host { return true }
+        if ip, err := t.dns.Resolve(host); err == nil && role.MainHost == ip { return true }
+    }
+    return false
+}
+
+/*! \brief Lines our config up with the topology
+    Returns true if the servers were the other way around from our config, in which case they've been swapped.
+    Errors if both servers claim to be the main, or the ports don't agree on which one it is, since we can't safely pick
+*/
+func (t *tasks_c) reconcile (topo []portTopology_t) (swapped bool, err error) {
+    var report []string
+    mainCount, subCount, splitCount := 0, 0, 0
+
+    for _, p := range topo {
+        report = append(report, fmt.Sprintf("port %d: %s; %s", p.port, p.main, p.sub))
+
+        mainIsMain := p.main.err == nil && p.main.role.Main
+        subIsMain := p.sub.err == nil && p.sub.role.Main
+        switch {
+        case mainIsMain && subIsMain:
+            splitCount++
+        case mainIsMain:
+            mainCount++
+        case subIsMain:
+            subCount++
+        }
+    }
+
+    if splitCount > 0 {
+        return false, fmt.Errorf("Both servers claim to be the main, refusing to do anything until this is fixed by hand:\n  %s", strings.Join(report, "\n  "))
+    }
+    if mainCount > 0 && subCount > 0 {
+        return false, fmt.Errorf("Ports disagree on which server is the main, refusing to do anything until this is fixed by hand:\n  %s", strings.Join(report, "\n  "))
+    }
+
+    if subCount > 0 {   //the subordinate in our config is really the main, our config is stale
+        t.events.Add("reconcile", fmt.Sprintf("%s is already the main, updating our config to match:\n  %s", t.Config.Subordinate.PublicIP, strings.Join(report, "\n  ")))
+        t.swapServers()
+        for i := range topo {
+            topo[i].main, topo[i].sub = topo[i].sub, topo[i].main
+        }
+        return true, nil
+    }
+
+    log.Printf("Replication topology:\n  %s\n", strings.Join(report, "\n  "))
+    return false, nil
+}
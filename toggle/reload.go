@@ -0,0 +1,131 @@
+/*! \file reload.go
+    \brief Applies a re-read config file to the running tasks without restarting or kicking off a failover
+*/
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "reflect"
+    "strings"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+func hasPort (ports []int, port int) bool {
+    for _, p := range ports {
+        if p == port { return true }
+    }
+    return false
+}
+
+/*! \brief Returns true if both are at the same address, timeouts and priority can change without it being a different server
+*/
+func sameServer (a, b server_t) bool {
+    return a.PublicIP == b.PublicIP && a.PrivateIP == b.PrivateIP
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Swaps in a new config, setting up any added ports or changed servers and re-rendering nginx if needed
+    If the new config has our two servers the other way around it's from before a switch, so we keep our current main
+    and return rewrite as true so the caller can fix the file.
+    A server that's going to be the main has to be reachable on every port it's taking over, otherwise we keep the current config
+*/
+func (t *tasks_c) Reload (config appConfig_t) (rewrite bool, err error) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if len(config.DNS.SRV) > 0 {   //the file won't have the ports in it
+        t.dns.SetTTL(time.Second * time.Duration(config.DNS.TTL))
+        if config.Ports, err = t.dns.Ports(config.DNS.SRV); err != nil { return false, err }
+    }
+    return t.reload(config)
+}
+
+/*! \brief Does the actual reload, callers need to be holding t.lock
+*/
+func (t *tasks_c) reload (config appConfig_t) (rewrite bool, err error) {
+    t.status.Begin("reload")
+    defer t.status.End()
+
+    current := t.CurrentConfig()
+
+    if config.Main.PublicIP == current.Subordinate.PublicIP && config.Subordinate.PublicIP == current.Main.PublicIP {
+        log.Printf("Config file has %s as the main, keeping the current main %s\n", config.Main.PublicIP, current.Main.PublicIP)
+        config.Main, config.Subordinate = config.Subordinate, config.Main
+        rewrite = true
+    }
+
+    mainChanged := !sameServer(config.Main, current.Main)
+    subChanged := !sameServer(config.Subordinate, current.Subordinate)
+
+    var changes []string
+    if mainChanged { changes = append(changes, "main " + config.Main.PublicIP) }
+    if subChanged { changes = append(changes, "subordinate " + config.Subordinate.PublicIP) }
+    if !mainChanged && config.Main != current.Main { changes = append(changes, "main settings") }   //picked up with the rest of the config
+    if !subChanged && config.Subordinate != current.Subordinate { changes = append(changes, "subordinate settings") }
+    for _, port := range config.Ports {
+        if !hasPort(current.Ports, port) {
+            changes = append(changes, fmt.Sprintf("added port %d", port))
+
+            if !mainChanged && !t.checkRedis(config.Main.PublicIP, port, false) {
+                return false, fmt.Errorf("Main %s:%d isn't reachable, keeping the current config", config.Main.PublicIP, port)
+            }
+        }
+    }
+    for _, port := range current.Ports {
+        if !hasPort(config.Ports, port) { changes = append(changes, fmt.Sprintf("removed port %d", port)) }
+    }
+
+    if mainChanged {
+        for _, port := range config.Ports {
+            if !t.checkRedis(config.Main.PublicIP, port, false) {
+                return false, fmt.Errorf("New main %s:%d isn't reachable, keeping the current config", config.Main.PublicIP, port)
+            }
+        }
+    }
+
+    //make sure the servers are correctly identified as main/subordinate, but only where something changed
+    for _, port := range config.Ports {
+        added := !hasPort(current.Ports, port)
+        if mainChanged || added {
+            if err = t.subordinateof(config.Main.PublicIP, port, "no", "one"); err != nil {
+                return false, fmt.Errorf("Unable to make %s:%d the main :: %s", config.Main.PublicIP, port, err.Error())
+            }
+        }
+        if mainChanged || subChanged || added {
+            if err := t.subordinateof(config.Subordinate.PublicIP, port, config.Main.PrivateIP, fmt.Sprintf("%d", port)); err != nil {
+                log.Printf("Unable to point subordinate %s:%d at the main :: %s\n", config.Subordinate.PublicIP, port, err.Error())  //not fatal, same as at startup
+            }
+        }
+    }
+
+    t.cfgLock.Lock()
+    *t.Config = config
+    t.cfgLock.Unlock()
+    t.applySettings()
+
+    if !reflect.DeepEqual(config.State, current.State) {
+        t.setStore(config.State)
+        changes = append(changes, "state backend " + config.State.Backend)
+    }
+    if mainChanged || subChanged {
+        t.saveState()
+    }
+
+    if mainChanged || !reflect.DeepEqual(config.Ports, current.Ports) || !reflect.DeepEqual(config.Nginx, current.Nginx) {
+        t.updateNginx(config.Main.PublicIP)
+        if !mainChanged && !reflect.DeepEqual(config.Nginx, current.Nginx) { changes = append(changes, "nginx settings") }
+    }
+
+    if len(changes) == 0 { changes = append(changes, "no changes") }
+    t.events.Add("reload", "Config reloaded: " + strings.Join(changes, ", "))
+    return rewrite, nil
+}
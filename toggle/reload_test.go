@@ -0,0 +1,74 @@
+package main
+
+import (
+    "path/filepath"
+    "testing"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+    "github.com/NathanRThomas/redisToggle/store"
+)
+
+func TestReloadSwapped (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    config := tasks.CurrentConfig()
+    config.Main, config.Subordinate = config.Subordinate, config.Main   //the file's from before our last switch
+
+    rewrite, err := tasks.Reload(config)
+    if err != nil { t.Fatal(err) }
+    if !rewrite { t.Fatal("Swapped servers didn't ask for the file to be rewritten") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Reload switched the main to %s", tasks.Config.Main.PublicIP) }
+    for _, ip := range []string{ testMain, testSub } {
+        if calls := network.Server(ip, 6379).Calls(); len(calls) > 0 { t.Fatalf("Reload touched %s: %v", ip, calls) }
+    }
+}
+
+func TestReloadConfigFileSwapped (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+    fileLoc := filepath.Join(t.TempDir(), "toggle.conf")
+    config := tasks.CurrentConfig()
+    config.Main, config.Subordinate = config.Subordinate, config.Main
+    writeConfig(&config, fileLoc)
+
+    if err := reloadConfig(tasks, fileLoc); err != nil { t.Fatal(err) }
+    var fixed appConfig_t
+    if err := loadConfig(&fixed, fileLoc); err != nil || fixed.Main.PublicIP != testMain { t.Fatalf("File wasn't fixed to our main: %+v %v", fixed.Main, err) }
+}
+
+func TestReloadAddPort (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    config := tasks.CurrentConfig()
+    config.Ports = []int{ 6379, 6380 }
+
+    if rewrite, err := tasks.Reload(config); err != nil || rewrite { t.Fatalf("Reload failed: %v %v", rewrite, err) }
+    if !hasCall(network.Server(testSub, 6380), "SLAVEOF " + testMain + " 6380") { t.Fatal("Subordinate wasn't pointed at the main on the new port") }
+    if len(network.Server(testSub, 6379).Calls()) > 0 { t.Fatal("Reload touched a port that didn't change") }
+}
+
+func TestReloadUnreachableMain (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server("10.0.0.3", 6379).SetDown(true)
+    config := tasks.CurrentConfig()
+    config.Main = server_t{ PublicIP: "10.0.0.3", PrivateIP: "10.0.0.3" }
+
+    if _, err := tasks.Reload(config); err == nil { t.Fatal("Reload moved to a main that's down") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if network.Server(testSub, 6379).Role() != (redis.Role_t{ MainHost: testMain, MainPort: 6379, LinkUp: true }) { t.Fatal("Subordinate was changed") }
+}
+
+func TestReloadServerSettings (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Store = &store.Memory_c{}
+    tasks.syncState()
+    config := tasks.CurrentConfig()
+    config.Main.Timeouts.ReadMs, config.Main.Priority, config.Subordinate.Timeouts.DialMs = 500, 5, 200
+
+    if rewrite, err := tasks.Reload(config); err != nil || rewrite { t.Fatalf("Reload failed: %v %v", rewrite, err) }
+    if tasks.Config.Main.Timeouts.ReadMs != 500 || tasks.Config.Main.Priority != 5 || tasks.Config.Subordinate.Timeouts.DialMs != 200 {
+        t.Fatalf("Settings weren't applied: %+v %+v", tasks.Config.Main, tasks.Config.Subordinate)
+    }
+    for _, ip := range []string{ testMain, testSub } {
+        if calls := network.Server(ip, 6379).Calls(); len(calls) > 0 { t.Fatalf("Reload touched %s: %v", ip, calls) }
+    }
+    if len(tasks.nginxIP) > 0 { t.Fatal("Reload re-rendered nginx") }
+    if state, _ := tasks.Store.Load(); state.Version != 1 { t.Fatalf("Reload saved the state again: %+v", state) }
+}
@@ -0,0 +1,120 @@
+/*! \file resolve.go
+    \brief Resolves server hostnames and SRV records, caching the answers for a configurable TTL
+
+    Cloud VMs can change ip addresses on us, so anything in the config can be a hostname.  We resolve it at each check
+    and hang on to the last good answer if DNS goes away for a bit.
+*/
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type resolved_t struct {
+    addr        string
+    ports       []int
+    expires     time.Time
+}
+
+type resolver_c struct {
+    ttl         time.Duration   //how long we trust an answer, 0 means we look it up every time, see SetTTL
+    lock        sync.Mutex
+    cache       map[string]resolved_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns the cached entry for this key, and whether it's still good
+*/
+func (r *resolver_c) cached (key string) (resolved_t, bool, bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    entry, ok := r.cache[key]
+    return entry, ok, ok && time.Now().Before(entry.expires)
+}
+
+func (r *resolver_c) save (key string, entry resolved_t) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    entry.expires = time.Now().Add(r.ttl)
+    if r.cache == nil { r.cache = make(map[string]resolved_t) }
+    r.cache[key] = entry
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Sets how long answers are trusted, safe to call while lookups are going on
+*/
+func (r *resolver_c) SetTTL (ttl time.Duration) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    r.ttl = ttl
+}
+
+/*! \brief Returns the ip address for the host, ip addresses are passed straight back
+    If the lookup fails but we've resolved this host before, the last answer is returned
+*/
+func (r *resolver_c) Resolve (host string) (string, error) {
+    if net.ParseIP(host) != nil { return host, nil }    //nothing to do
+
+    entry, ok, fresh := r.cached(host)
+    if fresh { return entry.addr, nil }
+
+    addrs, err := net.LookupHost(host)
+    if err == nil && len(addrs) == 0 { err = fmt.Errorf("No addresses found") }
+    if err != nil {
+        if ok {
+            log.Printf("Unable to resolve %s, using last known address %s :: %s\n", host, entry.addr, err.Error())
+            return entry.addr, nil
+        }
+        return "", fmt.Errorf("Unable to resolve %s :: %s", host, err.Error())
+    }
+
+    if ok && entry.addr != addrs[0] {
+        log.Printf("%s now resolves to %s, was %s\n", host, addrs[0], entry.addr)
+    }
+    r.save(host, resolved_t{ addr: addrs[0] })
+    return addrs[0], nil
+}
+
+/*! \brief Returns the sorted list of unique ports from an SRV record like _redis._tcp.example.com
+*/
+func (r *resolver_c) Ports (name string) ([]int, error) {
+    entry, ok, fresh := r.cached("srv:" + name)
+    if fresh { return entry.ports, nil }
+
+    _, records, err := net.LookupSRV("", "", name)
+    if err == nil && len(records) == 0 { err = fmt.Errorf("No records found") }
+    if err != nil {
+        if ok {
+            log.Printf("Unable to look up SRV %s, using last known ports %v :: %s\n", name, entry.ports, err.Error())
+            return entry.ports, nil
+        }
+        return nil, fmt.Errorf("Unable to look up SRV %s :: %s", name, err.Error())
+    }
+
+    seen := make(map[int]bool)
+    ports := make([]int, 0, len(records))
+    for _, rec := range records {
+        if !seen[int(rec.Port)] { ports = append(ports, int(rec.Port)) }
+        seen[int(rec.Port)] = true
+    }
+    sort.Ints(ports)
+
+    r.save("srv:" + name, resolved_t{ ports: ports })
+    return ports, nil
+}
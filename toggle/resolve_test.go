@@ -0,0 +1,28 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+//run with -race, the demoters resolve in the background while a reload changes the ttl
+func TestResolverSetTTL (t *testing.T) {
+    var r resolver_c
+    wg := new(sync.WaitGroup)
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func () {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                if _, err := r.Resolve("localhost"); err != nil { t.Error(err); return }
+            }
+        }()
+    }
+    for i := 0; i < 20; i++ { r.SetTTL(time.Duration(i) * time.Millisecond) }
+    wg.Wait()
+
+    r.SetTTL(time.Minute)
+    r.Resolve("localhost")
+    if _, _, fresh := r.cached("localhost"); !fresh { t.Fatal("Answer wasn't cached for the new ttl") }
+}
@@ -0,0 +1,96 @@
+/*! \file shutdown.go
+    \brief Stopping without leaving a switch half done
+
+    Once tasks_c.Ctx is cancelled nothing new gets started.  A check that's still retrying the main gives up without
+    failing over, and a graceful switch that's waiting for the subordinate aborts and puts everything back.  A forced
+    switch doesn't wait on anything, so it's left to finish.  Shutdown then waits, up to its deadline, for whatever holds
+    t.lock to be done before saving our state, stopping the demotions and closing the connections.
+*/
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io/ioutil"
+    "sync"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Returns a channel that's closed once we're shutting down, it's never closed when there's no Ctx
+*/
+func (t *tasks_c) done () <-chan struct{} {
+    if t.Ctx == nil { return nil }
+    return t.Ctx.Done()
+}
+
+func (t *tasks_c) stopping () bool {
+    select {
+    case <-t.done():
+        return true
+    default:
+        return false
+    }
+}
+
+/*! \brief Takes the lock, giving up once ctx is done, in which case it's let go of whenever we do get it
+    Returns false if we gave up
+*/
+func lockWithin (ctx context.Context, lock *sync.Mutex) bool {
+    locked := make(chan struct{}, 1)
+    go func () {
+        lock.Lock()
+        locked <- struct{}{}
+    }()
+
+    select {
+    case <-locked:
+        return true
+    case <-ctx.Done():
+        go func () {    //we gave up waiting, so let go of it whenever we do get it
+            <-locked
+            lock.Unlock()
+        }()
+        return false
+    }
+}
+
+/*! \brief Writes the config file if it doesn't already match what we've got, callers need to be holding t.lock
+*/
+func (t *tasks_c) persistConfig (fileLoc string) {
+    config := t.CurrentConfig()
+    byt, err := encodeConfig(&config, configFormat(fileLoc))
+    if err != nil { return }    //WriteConfig would only fail the same way
+    if current, err := ioutil.ReadFile(fileLoc); err == nil && bytes.Equal(current, byt) { return }
+    t.WriteConfig(fileLoc)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Waits for any check or switch to finish, then saves the state store and config file and lets go of everything
+    Cancel Ctx before calling this, or a check that's retrying the main will run to the end.  Gives up when ctx is done
+*/
+func (t *tasks_c) Shutdown (ctx context.Context, fileLoc string) error {
+    if !lockWithin(ctx, &t.lock) {
+        if op := t.Status().Operation; op != nil {
+            return fmt.Errorf("Gave up waiting for the %s started at %s to finish :: %s", op.Name, op.Started.Format("15:04:05"), ctx.Err().Error())
+        }
+        return fmt.Errorf("Gave up waiting for the current check to finish :: %s", ctx.Err().Error())
+    }
+    defer t.lock.Unlock()
+
+    if t.Plan == nil {  //a dry run never changed anything, so there's nothing to save
+        t.saveState()
+        t.persistConfig(fileLoc)
+    }
+    t.demoter.stopAll()
+    t.conns.closeAll()
+    t.events.Add("shutdown", fmt.Sprintf("Stopped with %s as the main", t.Config.Main.PublicIP))
+    return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestShutdownDuringCheck (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    ctx, cancel := context.WithCancel(context.Background())
+    tasks.Ctx, tasks.Retry = ctx, 60    //the check would otherwise retry the main for a minute
+    network.Server(testMain, 6379).SetDown(true)
+
+    time.AfterFunc(time.Millisecond * 50, cancel)
+    start := time.Now()
+    if tasks.Check() { t.Fatal("Failed over while shutting down") }
+    if time.Since(start) > time.Second * 5 { t.Fatal("Check didn't stop retrying when we shut down") }
+
+    fileLoc := filepath.Join(t.TempDir(), "toggle.conf")
+    if err := tasks.Shutdown(context.Background(), fileLoc); err != nil { t.Fatal(err) }
+    var config appConfig_t
+    if err := loadConfig(&config, fileLoc); err != nil || config.Main.PublicIP != testMain { t.Fatalf("Config wasn't saved: %v %+v", err, config.Main) }
+    if !hasEvent(tasks, "shutdown") { t.Fatalf("Missing shutdown event: %+v", tasks.History()) }
+}
+
+func TestShutdownGracefulSwitch (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    ctx, cancel := context.WithCancel(context.Background())
+    tasks.Ctx = ctx
+    network.Server(testMain, 6379).SetOffset(100)
+    network.Server(testSub, 6379).SetOffset(50)
+
+    time.AfterFunc(time.Millisecond * 50, cancel)
+    err := tasks.GracefulSwitch(time.Minute)
+    if err == nil || !strings.Contains(err.Error(), "Shutting down") { t.Fatalf("Expected the switch to be aborted, got %v", err) }
+    if network.Server(testMain, 6379).Paused() || tasks.Config.Main.PublicIP != testMain { t.Fatal("Switch wasn't rolled back") }
+}
+
+func TestShutdownTimeout (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+    tasks.lock.Lock()   //a switch that never finishes
+    tasks.status.Begin("switch")
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    err := tasks.Shutdown(ctx, filepath.Join(t.TempDir(), "toggle.conf"))
+    if err == nil || !strings.Contains(err.Error(), "switch") { t.Fatalf("Expected to give up on the switch, got %v", err) }
+
+    tasks.lock.Unlock()
+    if !tasks.lock.TryLock() {     //the lock's let go of once we do get it
+        time.Sleep(time.Millisecond * 50)
+        if !tasks.lock.TryLock() { t.Fatal("Shutdown kept hold of the lock") }
+    }
+}
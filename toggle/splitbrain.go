@@ -0,0 +1,149 @@
+/*! \file splitbrain.go
+    \brief Keeps checking that the roles of the servers are what we think they are while we're running
+
+    Someone running SLAVEOF no one by hand, or another toggle host switching without a shared state store, can leave both
+    servers thinking they're the main.  When that happens we raise an alert and resolve it according to the split_brain setting
+        manual  - (default) pause automatic failover until someone fixes it by hand
+        config  - keep the main from our config, the other server goes back to replicating from it
+        offset  - keep whichever server has the highest replication offset, the other replicates from it.  This only swaps
+                  the servers when every port is split, otherwise the main from our config is kept like config does
+    Any writes that went to the losing server since the split are lost.
+
+    A main that's replicating is only made the main again once we've seen the subordinate isn't, if the subordinate is the
+    main on every port someone switched without us and we follow along.  If we can't reach the subordinate we alert and leave
+    it, another toggle host may have switched to it from the other side of a partition.
+*/
+
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- CONST -------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+const (
+    splitBrainManual    = "manual"
+    splitBrainConfig    = "config"
+    splitBrainOffset    = "offset"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Resolves a split brain on the ports passed in according to our policy
+    Returns true if the main and subordinate were swapped
+*/
+func (t *tasks_c) resolveSplitBrain (split []portTopology_t) (swapped bool) {
+    var report []string
+    var mainOffset, subOffset int64
+    for _, p := range split {
+        report = append(report, fmt.Sprintf("port %d: %s; %s", p.port, p.main, p.sub))
+        mainOffset += p.main.role.Offset
+        subOffset += p.sub.role.Offset
+    }
+
+    policy := t.Config.SplitBrain
+    if len(policy) == 0 { policy = splitBrainManual }
+
+    if !t.splitBrain {  //only alert when it starts, not on every check
+        t.alert("split-brain", fmt.Sprintf("Both servers claim to be the main, resolving with policy %s:\n  %s", policy, strings.Join(report, "\n  ")))
+    }
+    t.splitBrain = true
+
+    switch policy {
+    case splitBrainOffset:
+        if subOffset > mainOffset && len(split) < len(t.Config.Ports) {    //swapping would leave the other ports replicating from the loser
+            t.events.Add("split-brain", fmt.Sprintf("%s has the highest offset but only %d of %d ports are split, keeping %s as the main",
+                t.Config.Subordinate.PublicIP, len(split), len(t.Config.Ports), t.Config.Main.PublicIP))
+        } else if subOffset > mainOffset { //the subordinate has more data, so it wins
+            t.events.Add("split-brain", fmt.Sprintf("%s has the highest offset, making it the main", t.Config.Subordinate.PublicIP))
+            t.swapServers()
+            t.updateNginx(t.Config.Main.PublicIP)
+            swapped = true
+        }
+        fallthrough
+
+    case splitBrainConfig:
+        for _, p := range split {
+            if err := t.subordinateof(t.Config.Subordinate.PublicIP, p.port, t.Config.Main.PrivateIP, fmt.Sprintf("%d", p.port)); err != nil {
+                t.events.Add("error", fmt.Sprintf("Unable to demote %s:%d :: %s", t.Config.Subordinate.PublicIP, p.port, err.Error()))
+                return  //we'll try again next check
+            }
+        }
+        t.events.Add("split-brain", fmt.Sprintf("Resolved, %s is the main and %s is replicating from it", t.Config.Main.PublicIP, t.Config.Subordinate.PublicIP))
+        t.splitBrain = false
+
+    default:
+        if !t.status.Paused() {
+            t.Pause(true)   //nothing automatic until someone sorts this out, they'll need to resume afterwards
+        }
+    }
+    return
+}
+
+/*! \brief Checks the role of every server on every port, pointing a wandering subordinate back at the main
+    and resolving a split brain if there is one.  Returns true if the main and subordinate were swapped
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) verifyRoles () bool {
+    topo := t.topology()
+    var split []portTopology_t
+    taken, unseen := false, false
+    for _, p := range topo {
+        if p.main.err != nil { continue }   //the health checks deal with the main being down
+        subIsMain := p.sub.err == nil && p.sub.role.Main
+
+        switch {
+        case p.main.role.Main && subIsMain:
+            split = append(split, p)
+        case p.main.role.Main:
+            if p.sub.err == nil && !t.replicatesFrom(p.sub.role, t.Config.Main, p.port) {
+                t.events.Add("role", fmt.Sprintf("Subordinate on port %d isn't replicating from the main, pointing it back: %s", p.port, p.sub))
+                t.subordinateof(t.Config.Subordinate.PublicIP, p.port, t.Config.Main.PrivateIP, fmt.Sprintf("%d", p.port))
+            }
+        case subIsMain:
+            taken = true    //sorted out below, once we've seen every port
+        case p.sub.err != nil:  //another toggle host may have made the subordinate the main, resetting ours would be a split brain
+            unseen = true
+            if !t.replicating {
+                t.alert("role", fmt.Sprintf("Main on port %d is replicating and the subordinate can't be reached, leaving it alone: %s; %s", p.port, p.main, p.sub))
+            }
+        default:    //nothing's taking writes on this port, so it's safe to put our main back
+            t.events.Add("role", fmt.Sprintf("Main on port %d is replicating and the subordinate isn't the main, resetting it: %s; %s", p.port, p.main, p.sub))
+            if err := t.subordinateof(t.Config.Main.PublicIP, p.port, "no", "one"); err != nil {
+                t.events.Add("error", fmt.Sprintf("Unable to reset %s:%d as the main :: %s", t.Config.Main.PublicIP, p.port, err.Error()))
+            }
+        }
+    }
+
+    t.replicating = unseen  //so we only alert once each time it happens
+
+    if taken && len(split) == 0 {   //the subordinate's the main, either everywhere and our config is stale, or the ports disagree
+        swapped, err := t.reconcile(topo)
+        if err != nil {
+            if !t.status.Paused() {
+                t.alert("role", err.Error())
+                t.Pause(true)   //same as a split brain with the manual policy, someone needs to look at this
+            }
+            return false
+        }
+        if swapped {
+            t.updateNginx(t.Config.Main.PublicIP)
+            return true
+        }
+    }
+
+    if len(split) == 0 {
+        if t.splitBrain {
+            t.events.Add("split-brain", "Both servers no longer claim to be the main")
+            t.splitBrain = false
+        }
+        return false
+    }
+    return t.resolveSplitBrain(split)
+}
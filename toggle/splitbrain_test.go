@@ -0,0 +1,80 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+func TestCheckSplitBrainConfig (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.SplitBrain = splitBrainConfig
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true })
+
+    if tasks.Check() { t.Fatal("Check swapped with the config policy") }
+    if role := network.Server(testSub, 6379).Role(); role.Main || role.MainHost != testMain { t.Fatalf("Subordinate wasn't demoted: %+v", role) }
+    if !hasEvent(tasks, "split-brain") { t.Fatal("No split brain event") }
+}
+
+func TestCheckSplitBrainManual (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true })
+
+    tasks.Check()
+    if !tasks.status.Paused() { t.Fatal("Failover wasn't paused with the manual policy") }
+    if !network.Server(testSub, 6379).Role().Main { t.Fatal("Subordinate was demoted with the manual policy") }
+}
+
+func TestCheckSplitBrainOffset (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Config.SplitBrain = splitBrainOffset
+    network.Server(testMain, 6379).SetOffset(100)
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true, Offset: 500 })
+
+    if !tasks.Check() { t.Fatal("Check didn't swap to the server with the highest offset") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    if role := network.Server(testMain, 6379).Role(); role.Main || role.MainHost != testSub { t.Fatalf("Old main wasn't demoted: %+v", role) }
+}
+
+func TestCheckSplitBrainOffsetPartial (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    tasks.Config.SplitBrain = splitBrainOffset
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true, Offset: 500 })  //only one port is split
+
+    if tasks.Check() { t.Fatal("Check swapped with only some of the ports split") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    for _, port := range []int{ 6379, 6380 } {
+        if role := network.Server(testSub, port).Role(); role.Main || role.MainHost != testMain { t.Fatalf("Subordinate on %d isn't replicating from the main: %+v", port, role) }
+        if !network.Server(testMain, port).Role().Main { t.Fatalf("Main on %d isn't the main", port) }
+    }
+}
+
+func TestCheckFollowsOtherSwitch (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    for _, port := range []int{ 6379, 6380 } {    //someone else switched, our config is stale
+        network.Server(testSub, port).SetRole(redis.Role_t{ Main: true })
+        network.Server(testMain, port).SetRole(redis.Role_t{ MainHost: testSub, MainPort: port, LinkUp: true })
+    }
+
+    if !tasks.Check() { t.Fatal("Check didn't follow the switch") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    for _, port := range []int{ 6379, 6380 } {
+        if main := network.Server(testMain, port); hasCall(main, "SLAVEOF no one") { t.Fatalf("Old main on %d was reset as the main: %v", port, main.Calls()) }
+    }
+}
+
+func TestCheckReplicatingMainSubordinateDown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    main := network.Server(testMain, 6379)
+    main.SetRole(redis.Role_t{ MainHost: testSub, MainPort: 6379, LinkUp: true })  //someone we can't see switched to the subordinate
+    network.Server(testSub, 6379).SetDown(true)
+
+    tasks.Check()
+    tasks.Check()
+    if main.Role().Main || hasCall(main, "SLAVEOF no one") { t.Fatal("Replicating main was reset without seeing the subordinate") }
+    count := 0
+    for _, e := range tasks.History() {
+        if e.Kind == "role" { count++ }
+    }
+    if count != 1 { t.Fatalf("Expected one role alert, got %d", count) }
+}
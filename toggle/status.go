@@ -0,0 +1,158 @@
+/*! \file status.go
+    \brief Keeps track of what toggle has seen and is doing, so it can be reported through the admin api
+*/
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type health_t struct {
+    Healthy     bool        `json:"healthy"`     //false only when it's down, a degraded server is still healthy enough to use
+    State       string      `json:"state,omitempty"`
+    LastCheck   time.Time   `json:"last_check"`
+    LatencyMs   float64     `json:"latency_ms,omitempty"`
+    Error       string      `json:"error,omitempty"`
+    Rejected    int64       `json:"rejected_connections,omitempty"`  //from the last INFO check, so we can see it going up
+    infoSeen    bool        //true once Rejected came from an INFO check
+}
+
+type nodeStatus_t struct {
+    IP      string      `json:"ip"`
+    Role    string      `json:"role"`
+    health_t
+}
+
+type portStatus_t struct {
+    Port        int             `json:"port"`
+    Nodes       []nodeStatus_t  `json:"nodes"`
+}
+
+type operation_t struct {
+    Name        string      `json:"name"`
+    Started     time.Time   `json:"started"`
+}
+
+//what we hand back from GET /status
+type status_t struct {
+    Version     string          `json:"version"`
+    Main        string          `json:"main"`
+    Subordinate string          `json:"subordinate"`
+    Paused      bool            `json:"paused"`
+    Operation   *operation_t    `json:"operation,omitempty"` //nil when we're idle
+    Connections connStats_t     `json:"connections"`
+    Faults      []fault_t       `json:"faults,omitempty"`    //chaos faults running or waiting to
+    Demotions   []demotion_t    `json:"demotions,omitempty"` //old mains we're still trying to demote
+    Ports       []portStatus_t  `json:"ports"`
+}
+
+type status_c struct {
+    lock        sync.RWMutex
+    health      map[string]health_t //keyed by ip:port
+    paused      bool
+    operation   *operation_t
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Records whether we could reach a redis server
+    Anything a deeper health check found is kept as long as the server's still reachable
+*/
+func (s *status_c) Record (ip string, port int, err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.health == nil { s.health = make(map[string]health_t) }
+
+    key := fmt.Sprintf("%s:%d", ip, port)
+    h := s.health[key]
+    h.LastCheck = time.Now()
+    if err != nil {
+        h.Healthy, h.State, h.Error = false, redis.StateDown, err.Error()
+    } else if h.State != redis.StateDegraded {
+        h.Healthy, h.State, h.Error = true, redis.StateHealthy, ""
+    }
+    s.health[key] = h
+}
+
+/*! \brief Records the result of a health check against a redis server, returning what it was before this
+*/
+func (s *status_c) RecordHealth (ip string, port int, rh redis.Health_t) (prev health_t) {
+    h := health_t{ Healthy: rh.State != redis.StateDown, State: rh.State, LastCheck: time.Now(), Rejected: rh.Rejected,
+        LatencyMs: float64(rh.Latency.Microseconds()) / 1000, Error: strings.Join(rh.Reasons, ", ") }
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.health == nil { s.health = make(map[string]health_t) }
+
+    key := fmt.Sprintf("%s:%d", ip, port)
+    prev = s.health[key]
+    if h.Rejected < 0 {     //we didn't look this time
+        h.Rejected, h.infoSeen = prev.Rejected, prev.infoSeen
+    } else {
+        h.infoSeen = true
+    }
+    s.health[key] = h
+    return
+}
+
+func (s *status_c) SetPaused (paused bool) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.paused = paused
+}
+
+func (s *status_c) Paused () bool {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return s.paused
+}
+
+/*! \brief Marks the start of an operation, like a switch, that's in progress
+*/
+func (s *status_c) Begin (name string) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.operation = &operation_t{ Name: name, Started: time.Now() }
+}
+
+func (s *status_c) End () {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.operation = nil
+}
+
+/*! \brief Builds the current status from what we've recorded and the config passed in
+*/
+func (s *status_c) Report (config appConfig_t) (ret status_t) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+
+    ret.Version = API_VER
+    ret.Main = config.Main.PublicIP
+    ret.Subordinate = config.Subordinate.PublicIP
+    ret.Paused = s.paused
+    ret.Operation = s.operation
+    ret.Ports = make([]portStatus_t, 0, len(config.Ports))
+
+    for _, port := range config.Ports {
+        p := portStatus_t{ Port: port }
+        for _, n := range []nodeStatus_t{ { IP: config.Main.PublicIP, Role: "main" }, { IP: config.Subordinate.PublicIP, Role: "subordinate" } } {
+            n.health_t = s.health[fmt.Sprintf("%s:%d", n.IP, port)]
+            p.Nodes = append(p.Nodes, n)
+        }
+        ret.Ports = append(ret.Ports, p)
+    }
+    return
+}
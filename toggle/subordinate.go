@@ -0,0 +1,241 @@
+/*! \file subordinate.go
+    \brief Handles running toggle as a subordinate, polling one or more main toggle services for the current setup
+
+    If none of them answer for Independent seconds we set up the same tasks a main toggle runs, from the last config we got,
+    and fail over ourselves if the main goes down.  That's all we do on our own, anything else is left for the main toggles.
+    A switch we make is saved to the state store when the main toggles gave us one, and they follow along either way once
+    they see the roles have changed.
+*/
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/nginx"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCT ------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+type mainAddr_t struct {
+    IP      string
+    Port    int
+}
+
+type subordinate_c struct {
+    Mains       []mainAddr_t    //main toggle services to poll, in order of preference
+    Independent int             //seconds without reaching any main toggle before we start checking redis ourselves, 0 disables
+    Retry       int
+    TestingFlag bool
+    NginxDir    string          //passed down to nginx, see nginx.Nginx_c
+    NginxReload string
+    ConfigFile  string          //where we keep the last config we applied, so we can come back up without a main toggle
+    Token       string          //admin token of the main toggles, optional, they only send their state backend with it
+    Ctx         context.Context //cancelled when we're shutting down, see tasks_c.Ctx
+
+    tasks       tasks_c
+    nginx       nginx.Nginx_c
+    config      appConfig_t     //last config we got from a main toggle
+    applied     *appConfig_t    //last config we rendered nginx with, nil if we haven't yet
+    nginxIP     string          //what the main resolved to when we rendered nginx
+    lastContact time.Time
+    independent bool            //true while we're running our own redis checks
+    lock        sync.Mutex      //held for each tick, so Shutdown waits for one that's failing over to finish
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Asks each of the main toggle services in order for the current setup, the first one to answer wins
+*/
+func (s *subordinate_c) poll () (config appConfig_t, err error) {
+    for _, m := range s.Mains {
+        config, err = s.tasks.SubordinateCheck(m.IP, m.Port, s.Token)
+        if err == nil {
+            return  //we got one
+        }
+        log.Println(err)    //try the next one
+    }
+    if err == nil { err = fmt.Errorf("No main toggle services to poll") }
+    return
+}
+
+/*! \brief Returns true if anything nginx is rendered from is different between the two configs
+*/
+func nginxChanged (a, b appConfig_t) bool {
+    return a.Main.PrivateIP != b.Main.PrivateIP || !reflect.DeepEqual(a.Ports, b.Ports) || !reflect.DeepEqual(a.Nginx, b.Nginx)
+}
+
+/*! \brief Updates nginx if anything relevant has changed since the last time we set it
+*/
+func (s *subordinate_c) apply (config appConfig_t) {
+    if len(s.ConfigFile) > 0 && !reflect.DeepEqual(s.config, config) {
+        writeConfig(&config, s.ConfigFile) //keep a local copy for when we restart
+    }
+    s.tasks.cfgLock.Lock()  //it's our tasks' config too, and their demotions read it in the background
+    s.config = config   //save this in case we have to go it alone later
+    s.tasks.cfgLock.Unlock()
+
+    ip := config.Main.PrivateIP
+    if len(config.Nginx.Resolver) == 0 {    //nginx can't resolve a hostname itself, so we do it, same as a main toggle
+        var err error
+        s.tasks.dns.SetTTL(time.Second * time.Duration(config.DNS.TTL))
+        if ip, err = s.tasks.dns.Resolve(ip); err != nil {
+            log.Printf("Unable to update nginx config :: %s\n", err.Error())
+            return  //we'll try again next time
+        }
+    }
+    if s.applied != nil && !nginxChanged(*s.applied, config) && ip == s.nginxIP { return } //nothing to do
+
+    log.Printf("Subordinate set config to %s with ports %v\n", config.Main.PrivateIP, config.Ports)
+    s.nginx.Options = config.Nginx
+    if err := s.nginx.Set (ip, config.Ports); err != nil {    //update nginx to reflect this new setup
+        log.Printf("Unable to update nginx config :: %s\n", err.Error())
+        return  //we'll try again next time
+    }
+    s.applied = &config  //it changed, so save it
+    s.nginxIP = ip
+}
+
+/*! \brief Sets our tasks up from the last config we got, the same way main does for a main toggle
+    Nginx is left to apply, so a switch renders it once, the same way we do when a main toggle tells us about one
+*/
+func (s *subordinate_c) startIndependent () {
+    s.tasks.Config = &s.config
+    s.tasks.setStore(s.config.State)    //the config may have changed since the last time we were on our own
+    s.tasks.Ctx = s.Ctx
+    if len(s.ConfigFile) > 0 { s.tasks.Journal = s.ConfigFile + ".journal" }
+    s.tasks.SkipNginx = true
+    s.tasks.applySettings()
+}
+
+/*! \brief We haven't been able to reach a main toggle for a while, so fail over ourselves if the main's down
+*/
+func (s *subordinate_c) checkIndependent () {
+    if len(s.config.Ports) < 1 { return }   //we never got a config, so there's nothing we can check
+
+    switched := false
+    if !s.independent {
+        log.Printf("No main toggle reachable for %d seconds, running independent redis checks\n", s.Independent)
+        s.independent = true
+        s.startIndependent()
+        switched = s.tasks.replayJournal()  //in case we stopped part way through a switch the last time we were on our own
+    }
+
+    if s.tasks.Failover() || switched { //we switched, so keep a copy and make sure nginx reflects it
+        if len(s.ConfigFile) > 0 { writeConfig(&s.config, s.ConfigFile) }
+        s.apply(s.config)
+    }
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS --------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+/*! \brief Parses a comma separated list of main toggle addresses, each one can be "ip" or "ip:port"
+    Entries without a port use the default port passed in
+*/
+func (s *subordinate_c) SetMains (list string, defaultPort int) error {
+    s.Mains = nil
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if len(entry) == 0 { continue }
+
+        m := mainAddr_t{ IP: entry, Port: defaultPort }
+        if host, port, err := net.SplitHostPort(entry); err == nil {
+            m.IP = host
+            if m.Port, err = strconv.Atoi(port); err != nil {
+                return fmt.Errorf("Main address %s has an invalid port", entry)
+            }
+        }
+
+        if len(m.IP) < 7 { //not a real ip check, but we need something to verify it looks good
+            return fmt.Errorf("Main ip %s appears invalid", entry)
+        }
+        if m.Port < 1 {
+            return fmt.Errorf("Main address %s needs a port, either as ip:port or with -p=", entry)
+        }
+        s.Mains = append(s.Mains, m)
+    }
+
+    if len(s.Mains) < 1 {
+        return fmt.Errorf("Main ip [--main=] appears invalid")
+    }
+    return nil
+}
+
+/*! \brief Loads the last config we applied and renders nginx with it
+    This lets a subordinate come up pointing at the right main even if no main toggle is reachable yet
+*/
+func (s *subordinate_c) Load () error {
+    if _, err := os.Stat(s.ConfigFile); os.IsNotExist(err) { return nil }    //first time we've run, nothing to load
+
+    var config appConfig_t
+    if err := loadConfig(&config, s.ConfigFile); err != nil {
+        return fmt.Errorf("Unable to read subordinate config %s :: %s", s.ConfigFile, err.Error())
+    }
+
+    s.nginx.TestingFlag = s.TestingFlag
+    s.nginx.Dir, s.nginx.Reload = s.NginxDir, s.NginxReload
+    s.config = config
+    s.apply(config)
+    return nil
+}
+
+/*! \brief Main entry point, call this every tick
+    Polls the main toggle services and updates nginx to match, if none of them answer for longer than Independent seconds
+    we'll start doing our own redis checks using the last config we got
+*/
+func (s *subordinate_c) Tick () {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.tasks.Retry = s.Retry
+    s.tasks.TestingFlag = s.TestingFlag
+    s.nginx.TestingFlag = s.TestingFlag
+    s.nginx.Dir, s.nginx.Reload = s.NginxDir, s.NginxReload
+    if s.lastContact.IsZero() { s.lastContact = time.Now() }  //first tick, start counting from here
+
+    config, err := s.poll()
+    if err == nil {
+        if s.independent {
+            log.Println("Main toggle reachable again, stopping independent redis checks")
+            s.independent = false
+        }
+        s.lastContact = time.Now()
+        s.apply(config)
+        return
+    }
+
+    if s.Independent > 0 && time.Since(s.lastContact) > time.Second * time.Duration(s.Independent) {
+        s.checkIndependent()
+    }
+}
+
+/*! \brief Waits for the current tick to finish, then stops our independent checks the same way a main toggle stops
+    Cancel Ctx first so a tick that's still retrying the main gives up.  Gives up when ctx is done, see tasks_c.Shutdown
+*/
+func (s *subordinate_c) Shutdown (ctx context.Context) error {
+    if !lockWithin(ctx, &s.lock) {
+        return fmt.Errorf("Gave up waiting for the current tick to finish :: %s", ctx.Err().Error())
+    }
+    defer s.lock.Unlock()
+
+    if !s.independent { //a main toggle is running things, we only have the connections and any demotions to let go of
+        s.tasks.demoter.stopAll()
+        s.tasks.conns.closeAll()
+        return nil
+    }
+    return s.tasks.Shutdown(ctx, s.ConfigFile)
+}
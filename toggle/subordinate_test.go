@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+    "github.com/NathanRThomas/redisToggle/redis/redistest"
+    "github.com/NathanRThomas/redisToggle/store"
+)
+
+//builds a subordinate that's lost its main toggles, with the last config it got from them
+func newTestSubordinate (t *testing.T, ports ...int) (*subordinate_c, *redistest.FakeNetwork_c) {
+    t.Helper()
+    tasks, network := newTestTasks(t, ports...)
+    dir := t.TempDir()
+    s := &subordinate_c{ TestingFlag: true, NginxDir: dir, ConfigFile: filepath.Join(dir, "subordinate.conf") }
+    s.config = *tasks.Config
+    s.config.State = state_t{ Backend: "file", Path: filepath.Join(dir, "state.json") }
+    s.tasks.Dialer = network.Dial
+    s.nginx.TestingFlag, s.nginx.Dir = true, dir    //Tick does this
+    return s, network
+}
+
+func TestSubordinateIndependentFailover (t *testing.T) {
+    s, network := newTestSubordinate(t, 6379)
+    network.Server(testMain, 6379).SetDown(true)
+
+    s.checkIndependent()
+    if s.config.Main.PublicIP != testSub { t.Fatalf("Didn't fail over, main is %s", s.config.Main.PublicIP) }
+    if !network.Server(testSub, 6379).Role().Main { t.Fatal("Subordinate wasn't promoted") }
+
+    //the main toggles find out through the state store, and we come back up pointing at the new main
+    state, err := (&store.File_c{ Path: s.config.State.Path }).Load()
+    if err != nil || state.Main != testSub { t.Fatalf("Switch wasn't saved to the state store: %+v %v", state, err) }
+    var config appConfig_t
+    if err := loadConfig(&config, s.ConfigFile); err != nil || config.Main.PublicIP != testSub { t.Fatalf("Local config wasn't written: %+v %v", config.Main, err) }
+
+    byt, err := ioutil.ReadFile(s.nginx.File())
+    if err != nil || !strings.Contains(string(byt), "server " + testSub + ":6379;") { t.Fatalf("Nginx wasn't pointed at the new main: %s %v", byt, err) }
+}
+
+func TestSubordinateIndependentPrivateIP (t *testing.T) {
+    s, network := newTestSubordinate(t, 6379)
+    s.config.Main.PrivateIP, s.config.Subordinate.PrivateIP = "192.168.0.1", "192.168.0.2"
+    s.apply(s.config)
+    network.Server(testMain, 6379).SetDown(true)
+
+    s.checkIndependent()
+    byt, err := ioutil.ReadFile(s.nginx.File())
+    if err != nil || !strings.Contains(string(byt), "server 192.168.0.2:6379;") || strings.Contains(string(byt), testSub) {
+        t.Fatalf("Nginx wasn't pointed at the new main's private ip: %s %v", byt, err)
+    }
+    if len(s.tasks.nginxIP) > 0 { t.Fatalf("Independent checks rendered nginx themselves with %s", s.tasks.nginxIP) }
+}
+
+func TestSubordinateIndependentFailoverOnly (t *testing.T) {
+    s, network := newTestSubordinate(t, 6379)
+    s.config.SplitBrain = splitBrainConfig
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true })
+
+    s.checkIndependent()
+    if !network.Server(testSub, 6379).Role().Main || len(network.Server(testSub, 6379).Calls()) > 0 { t.Fatal("Subordinate resolved a split brain on its own") }
+    if s.config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", s.config.Main.PublicIP) }
+}
+
+func TestSubordinateResolvesMain (t *testing.T) {
+    s, _ := newTestSubordinate(t, 6379)
+    config := s.config
+    config.Main.PrivateIP = "localhost"
+
+    s.apply(config)
+    byt, err := ioutil.ReadFile(s.nginx.File())
+    if err != nil { t.Fatal(err) }
+    if strings.Contains(string(byt), "localhost") || len(s.nginxIP) == 0 { t.Fatalf("Main's hostname wasn't resolved for nginx:\n%s", byt) }
+}
+
+func TestSubordinateShutdown (t *testing.T) {
+    s, network := newTestSubordinate(t, 6379)
+    network.Server(testMain, 6379).SetDown(true)
+    s.checkIndependent()
+
+    s.lock.Lock()   //a tick that's still going
+    go func () {
+        time.Sleep(time.Millisecond * 50)
+        s.lock.Unlock()
+    }()
+    start := time.Now()
+    if err := s.Shutdown(context.Background()); err != nil { t.Fatal(err) }
+    if time.Since(start) < time.Millisecond * 50 { t.Fatal("Shutdown didn't wait for the tick to finish") }
+    if !hasEvent(&s.tasks, "shutdown") { t.Fatal("Independent checks weren't shut down") }
+    if len(s.tasks.demoter.report()) > 0 { t.Fatal("Demotions are still running") }
+}
+
+func TestSubordinateShutdownTimeout (t *testing.T) {
+    s, _ := newTestSubordinate(t, 6379)
+    s.lock.Lock()   //a tick that never finishes
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    if err := s.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "Gave up") { t.Fatalf("Expected Shutdown to give up, got %v", err) }
+}
@@ -5,83 +5,323 @@
 package main
 
 import (
+    "context"
     "fmt"
     "log"
+    "reflect"
+    "strings"
+    "sync"
     "time"
     "encoding/json"
     "net/http"
 
     "github.com/NathanRThomas/redisToggle/redis"
     "github.com/NathanRThomas/redisToggle/nginx"
+    "github.com/NathanRThomas/redisToggle/store"
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- STRUCT ------------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
-type server_t struct {
-    PublicIP    string  `json:"public_ip"`
-    PrivateIP   string  `json:"private_ip"`
-}
-
-//app config for what we're monitoring
-type appConfig_t  struct {
-    Main  server_t  `json:"main"`
-    Subordinate   server_t  `json:"subordinate"`
-    Ports   []int     `json:"ports"`
-}
-
 type tasks_c struct {
     Config  *appConfig_t
+    Store   store.Store_i   //shared record of the current main, nil when the config file is all we have
     Retry   int
     TestingFlag bool
+    Dialer  redis.Dialer_f  //how we connect to the redis servers, real ones when nil
+    NginxDir    string      //passed down to nginx, see nginx.Nginx_c
+    NginxReload string
+    SkipNginx   bool        //nginx is rendered by someone else, an independent subordinate does its own, see subordinate.go
+    Plan    *plan_c         //when set this is a dry run, anything that would change something is recorded here instead, see plan.go
+    Ctx     context.Context //cancelled when we're shutting down, nothing new is started after that, see shutdown.go
+    Journal string          //file a switch in progress is recorded in, so it can be recovered after a crash, see journal.go
     nginx   nginx.Nginx_c
+    status  status_c
+    events  events_c
+    dns     resolver_c
+    alerts  alerter_c
+    detectors   map[string]*detector_c  //keyed by host:port
+    conns   connections_c   //open to every server on every port
+    chaos   chaos_c         //faults injected for failover drills, see chaos.go
+    demoter demoter_c       //old mains we're still trying to demote, see demoter.go
+    splitBrain  bool        //true while we know both servers think they're the main
+    replicating bool        //true while our main is replicating and we can't see the subordinate, see verifyRoles
+    failedFrom  string      //the main before our last automatic failover, where we fail back to, see failback.go
+    failbackSince   time.Time   //when the preferred server was first seen synced, zero when it isn't
+    switches    []time.Time     //automatic switches in the last hour, see damping.go
+    nginxIP string          //address nginx is currently rendered with, so we notice when a hostname moves
+    stateVersion    int64   //version of the state store we last loaded or saved, see store.Store_i
+    lock    sync.Mutex      //only one check or switch runs at a time
+    cfgLock sync.RWMutex    //protects Config while main and subordinate are swapped
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+/*! \brief Copies the settings from our config that the helpers need, call this whenever the config is replaced
+*/
+func (t *tasks_c) applySettings () {
+    t.dns.SetTTL(time.Second * time.Duration(t.Config.DNS.TTL))
+    t.alerts.Webhook = t.Config.Alerts.Webhook
+    for _, d := range t.detectors {
+        d.configure(t.Config.Detection)
+    }
+    t.conns.retain([]string{ t.Config.Main.PublicIP, t.Config.Subordinate.PublicIP }, t.Config.Ports)
+}
+
+/*! \brief Records an event and sends it anywhere alerts are configured to go
+*/
+func (t *tasks_c) alert (kind, message string) {
+    t.events.Add(kind, message)
+    if t.Plan != nil {
+        if len(t.alerts.Webhook) > 0 { t.Plan.add("hook", t.alerts.Webhook, "POST %s alert: %s", kind, message) }
+        return
+    }
+    t.alerts.Send(kind, message)
+}
+
+/*! \brief Returns the timeouts from our config for whichever server this host is, the defaults if it's neither
+*/
+func (t *tasks_c) timeouts (host string) redis.Timeouts_t {
+    t.cfgLock.RLock()   //the demotion retries call this in the background
+    defer t.cfgLock.RUnlock()
+    for _, s := range []server_t{ t.Config.Main, t.Config.Subordinate } {
+        if host == s.PublicIP || host == s.PrivateIP { return s.Timeouts }
+    }
+    return redis.Timeouts_t{}
+}
+
+/*! \brief Resolves the host, which can be an ip or a hostname, and returns the connection to the redis server on it
+    Connections are kept open between checks, don't close them, call t.conns.drop if the server stops answering
+*/
+func (t *tasks_c) connect (host string, port int) (redis.Client_i, error) {
+    ip, err := t.dns.Resolve(host)
+    if err != nil { return nil, err }
+
+    dial := t.Dialer
+    if dial == nil { dial = redis.Dialer(connPoolSize, t.TestingFlag) }
+    r, err := t.conns.get(dial, host, ip, port, t.timeouts(host))
+    if err == nil && t.Plan != nil {
+        r = &planClient_c{ Client_i: r, plan: t.Plan, target: fmt.Sprintf("%s:%d", host, port) }
+    }
+    return r, err
+}
+
+/*! \brief Connects and runs the health check from our config, giving up once the check timeout is up
+*/
+func (t *tasks_c) health (ip string, port int, mainFlag bool) redis.Health_t {
+    result := make(chan redis.Health_t, 1)  //buffered so a check we gave up on can still finish in the background
+    go func (profile redis.Profile_t) {
+        ok, delay := t.chaosCheck(ip)
+        if !ok {
+            result <- redis.Health_t{ State: redis.StateDown, Rejected: -1, Reasons: []string{ "Simulated failure (chaos)" } }
+            return
+        }
+        r, err := t.connect(ip, port)
+        if err != nil {
+            result <- redis.Health_t{ State: redis.StateDown, Rejected: -1, Reasons: []string{ err.Error() } }
+            return
+        }
+        h := r.Health(mainFlag, profile)
+        if delay > 0 { h.AddLatency(delay, profile) }
+        if h.State == redis.StateDown { t.conns.drop(ip, port) }
+        result <- h
+    }(t.Config.Health)
+
+    timeout := t.Config.Detection.timeout()
+    if timeout == 0 { return <-result }
+
+    select {
+    case h := <-result:
+        return h
+    case <-time.After(timeout):
+        go t.conns.drop(ip, port)   //it could be wedged, so the next check starts over, this waits on a dial that's hung
+        return redis.Health_t{ State: redis.StateDown, Rejected: -1, Reasons: []string{ fmt.Sprintf("Check timed out after %s", timeout) } }
+    }
+}
+
+/*! \brief Runs the health check from our config against the server, returns false only if it's down
+    A server that's degraded raises an alert but still counts as up, so it never causes a failover on its own
+*/
 func (t *tasks_c) checkRedis (ip string, port int, mainFlag bool) bool {
-    r := redis.Redis_c { TestingFlag: t.TestingFlag }   //init a class
-    err := r.Connect(ip, port)
-    if err == nil {
-        defer r.Close()
-        err = r.Check(mainFlag)
+    h := t.health(ip, port, mainFlag)
+
+    prev := t.status.RecordHealth(ip, port, h)
+    if prev.infoSeen && h.Rejected > prev.Rejected {
+        h.Reasons = append(h.Reasons, fmt.Sprintf("Rejected %d connections since the last check", h.Rejected - prev.Rejected))
+        if h.State == redis.StateHealthy { h.State = redis.StateDegraded }
+        t.status.RecordHealth(ip, port, h)
     }
-    
-    if err == nil {
-        return true //we can connect
-    } else {
-        log.Printf("Unable to connect to redis server %s:%d :: %s", ip, port, err.Error())
+
+    switch h.State {
+    case redis.StateDown:
+        log.Printf("Unable to connect to redis server %s:%d :: %s", ip, port, strings.Join(h.Reasons, ", "))
         return false    //couldn't connect
+    case redis.StateDegraded:
+        if prev.State != redis.StateDegraded {  //only alert when it changes, not on every check
+            t.alert("degraded", fmt.Sprintf("Redis server %s:%d is degraded :: %s", ip, port, strings.Join(h.Reasons, ", ")))
+        }
+    default:
+        if prev.State == redis.StateDegraded {
+            t.events.Add("recovered", fmt.Sprintf("Redis server %s:%d is healthy again", ip, port))
+        }
     }
+    return true //we can connect
 }
 
-/*! \brief Tells the targer server who their new main is
+/*! \brief Points nginx at the host passed in, using the nginx settings from our config
+    Hostnames are resolved here unless nginx has a resolver of its own to use
 */
-func (t *tasks_c) subordinateof (targetIP string, targetPort int, newMainIP, newMainPort string) error {
-    r := redis.Redis_c { TestingFlag: t.TestingFlag }   //init a class
-    err := r.Connect(targetIP, targetPort)  //connect to the server
+func (t *tasks_c) updateNginx (host string) {
+    if t.SkipNginx { return }
+    ip := host
+    if len(t.Config.Nginx.Resolver) == 0 {
+        var err error
+        if ip, err = t.dns.Resolve(host); err != nil {
+            log.Printf("Unable to update nginx config :: %s\n", err.Error())
+            return
+        }
+    }
 
-    if err == nil {
-        defer r.Close()
-        err = r.Subordinateof(newMainIP, newMainPort)   //update the server to let it know who the new main is
+    t.nginx.Options = t.Config.Nginx
+    if t.Plan != nil {
+        t.Plan.nginx(&t.nginx, ip, t.Config.Ports)
+        t.nginxIP = ip
+        return
     }
+    if err := t.nginx.Set(ip, t.Config.Ports); err != nil {
+        log.Printf("Unable to update nginx config :: %s\n", err.Error())
+        return
+    }
+    t.nginxIP = ip
+}
+
+/*! \brief Re-renders nginx if the main's hostname now resolves somewhere else
+*/
+func (t *tasks_c) checkNginx () {
+    if len(t.nginxIP) == 0 || len(t.Config.Nginx.Resolver) > 0 { return }   //never rendered, or nginx handles this itself
+
+    ip, err := t.dns.Resolve(t.Config.Main.PublicIP)
+    if err == nil && ip != t.nginxIP {
+        t.events.Add("dns", fmt.Sprintf("Main %s moved from %s to %s, updating nginx", t.Config.Main.PublicIP, t.nginxIP, ip))
+        t.updateNginx(t.Config.Main.PublicIP)
+    }
+}
+
+/*! \brief Gets the list of ports from the SRV record if we have one, and applies it if it's changed
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) discoverPorts () error {
+    if len(t.Config.DNS.SRV) == 0 { return nil }
+
+    ports, err := t.dns.Ports(t.Config.DNS.SRV)
+    if err != nil { return err }
+    if reflect.DeepEqual(ports, t.Config.Ports) { return nil }  //nothing changed
+
+    if len(t.Config.Ports) == 0 {   //first time, we're starting up
+        t.cfgLock.Lock()
+        t.Config.Ports = ports
+        t.cfgLock.Unlock()
+        return nil
+    }
+
+    config := t.CurrentConfig()
+    config.Ports = ports
+    _, err = t.reload(config)
     return err
 }
 
-/*! \brief The goal here is to keep trying to tell the main that it's no longer the main
-    When this fails it ques itself up to try again
+/*! \brief Swaps the main and subordinate in our config and lets the state store know
 */
-func (t *tasks_c) mainToSubordinate (targetIP, newMainIP string, targetPort int) {
-    err := t.subordinateof(targetIP, targetPort, newMainIP, fmt.Sprintf("%d", targetPort))
-    if err != nil { //didn't work
-        time.Sleep(time.Second * 5) //sleep here, time is less important as whenever the server comes back online it will start to replicate where it left off
-        go t.mainToSubordinate (targetIP, newMainIP, targetPort)   //"recursive call", not actually recursive cause i was worried about a stack overflow
+func (t *tasks_c) swapServers () {
+    t.cfgLock.Lock()
+    t.Config.Main, t.Config.Subordinate = t.Config.Subordinate, t.Config.Main
+    t.cfgLock.Unlock()
+    t.saveState()
+}
+
+/*! \brief Swaps in the state store the config asks for, closing the one we had
+*/
+func (t *tasks_c) setStore (config state_t) {
+    if c, ok := t.Store.(interface{ Close () }); ok { c.Close() }  //the redis backend keeps a connection open
+    t.Store = newStore(config)
+    t.stateVersion = 0  //we haven't loaded this one yet
+}
+
+/*! \brief Records the current main and subordinate in the state store
+*/
+func (t *tasks_c) saveState () error {
+    return t.storeState(t.Config.Main, t.Config.Subordinate)
+}
+
+/*! \brief Saves the servers passed in to the state store, as long as nobody else has saved since we last loaded or saved it
+    Returns store.ErrStale when they have, in which case theirs is left alone and syncState follows it on the next check
+*/
+func (t *tasks_c) storeState (main, sub server_t) error {
+    if t.Store == nil { return nil }
+
+    state := store.State_t{ Main: main.PublicIP, Subordinate: sub.PublicIP, Updated: time.Now(), Version: t.stateVersion }
+    if t.Plan != nil {
+        t.Plan.add("state", t.Config.State.Backend, "save main %s, subordinate %s", state.Main, state.Subordinate)
+        return nil
+    }
+
+    version, err := t.Store.Save(state)
+    if err == store.ErrStale {
+        t.events.Add("state", fmt.Sprintf("Another toggle host saved the state since we last looked, not overwriting it with %s as the main", state.Main))
+    } else if err != nil {
+        t.events.Add("error", fmt.Sprintf("Unable to save state, other toggle hosts won't know %s is the main :: %s", state.Main, err.Error()))
     } else {
-        log.Printf("Old main %s converted to subordinate of %s:%s", targetIP, newMainIP, newMainIP) //log that this completed
+        t.stateVersion = version
+    }
+    return err
+}
+
+/*! \brief Makes sure we agree with the state store on who the main is
+    If another toggle host, or we before a restart, switched the servers we follow along without touching redis.
+    Returns true if we swapped and the config file needs to be written
+*/
+func (t *tasks_c) syncState () bool {
+    if t.Store == nil { return false }
+
+    state, err := t.Store.Load()
+    if err != nil {
+        log.Printf("Unable to load state, going with our config :: %s\n", err.Error())
+        return false
+    }
+    t.stateVersion = state.Version
+
+    if state.Empty() {  //first one here, so we get to say who the main is
+        t.saveState()
+    } else if state.Main == t.Config.Subordinate.PublicIP && state.Subordinate == t.Config.Main.PublicIP {
+        t.events.Add("state", fmt.Sprintf("State store has %s as the main since %s, following along", state.Main, state.Updated.Format("2006-01-02 15:04:05")))
+        t.cfgLock.Lock()
+        t.Config.Main, t.Config.Subordinate = t.Config.Subordinate, t.Config.Main
+        t.cfgLock.Unlock()
+        t.updateNginx(t.Config.Main.PublicIP)
+        return true
+    } else if state.Main != t.Config.Main.PublicIP {
+        log.Printf("State store has main %s which isn't one of our servers, ignoring it\n", state.Main)
+    }
+    return false
+}
+
+/*! \brief Tells the targer server who their new main is
+*/
+func (t *tasks_c) subordinateof (targetIP string, targetPort int, newMainIP, newMainPort string) error {
+    r, err := t.connect(targetIP, targetPort)  //connect to the server
+    if err == nil && newMainIP != "no" {
+        newMainIP, err = t.dns.Resolve(newMainIP)
     }
+
+    if err == nil {
+        if err = r.Subordinateof(newMainIP, newMainPort); err != nil {  //update the server to let it know who the new main is
+            t.conns.drop(targetIP, targetPort)
+        }
+    }
+    return err
 }
 
   //-------------------------------------------------------------------------------------------------------------------------//
@@ -92,66 +332,188 @@ func (t *tasks_c) mainToSubordinate (targetIP, newMainIP string, targetPort int)
     This is intended to be called once at startup, this will validate that we can initially start communicating with at least the main server
     We don't specifically care if we can't connect to the subordinate, although that is bad, we don't want that to prevent us from starting this service 
     on account of a bad subordinate connection
+    Before anything else we ask the servers what their roles actually are, so a stale config can't reverse a failover
+    Returns true if the main and subordinate were swapped and the config file needs to be written
 */
-func (t *tasks_c) ValidateConfig () {
+func (t *tasks_c) ValidateConfig () (ret bool) {
     t.nginx.TestingFlag = t.TestingFlag //pass this down
+    t.nginx.Dir, t.nginx.Reload = t.NginxDir, t.NginxReload
+    t.applySettings()
+
+    if err := t.discoverPorts(); err != nil {
+        log.Fatalln(err)
+    }
+    ret = t.replayJournal()     //finish off, or roll back, a switch we crashed in the middle of
+    ret = t.syncState() || ret  //in case we're out of date with the other toggle hosts
+
+    topo := t.topology()
+    swapped, err := t.reconcile(topo)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    ret = ret || swapped
 
     allGood := true     //default to this
-    for _, port := range t.Config.Ports {
-        if t.checkRedis(t.Config.Main.PublicIP, port, true) == false {  //see if we can connect to the main
+    for _, p := range topo {
+        if p.main.err != nil {  //see if we can connect to the main
             allGood = false
             break   //we couldn't connect to one of the main ports
         }
     }
 
     if !allGood {   //this didn't work, so now try to connect to the subordinate instead
-        for _, port := range t.Config.Ports {
-            if t.checkRedis(t.Config.Subordinate.PublicIP, port, false) == false {  //see if we can connect to the subordinate
+        for _, p := range topo {
+            if p.sub.err != nil {  //see if we can connect to the subordinate
                 //this is really bad, we couldn't successfully connect to the main or the subordinate, so we have to bail
-                log.Fatalf("Unable to connect to main or subordinate on port %d\n", port)
+                log.Fatalf("Unable to connect to main or subordinate on port %d\n", p.port)
             }
         }
-    }
 
-    if !allGood {   //in this case we couldn't talk to the main, but we could talk to the subordinate, so we want to switch them
-        if !t.Switch() {
+        //in this case we couldn't talk to the main, but we could talk to the subordinate, so we want to switch them
+        if !t.switchServers() {
             log.Fatalln("We were not able to convert the subordinate over to a main")
         }
+        ret = true
     } else {
         //if we're here, it's cuase things are good, so update the nginx config file to match our config
-        t.nginx.Set(t.Config.Main.PublicIP, t.Config.Ports)
+        t.updateNginx(t.Config.Main.PublicIP)
 
-        //now make sure the servers are correctly identified as main/subordinate
-        for _, port := range t.Config.Ports {
-            t.subordinateof(t.Config.Main.PublicIP, port, "no", "one")
-            t.subordinateof(t.Config.Subordinate.PublicIP, port, t.Config.Main.PrivateIP, fmt.Sprintf("%d", port))
+        //now make sure the servers are correctly identified as main/subordinate, only touching the ones that aren't
+        for _, p := range topo {
+            if !p.main.role.Main {
+                t.subordinateof(t.Config.Main.PublicIP, p.port, "no", "one")
+            }
+            if p.sub.err == nil && !t.replicatesFrom(p.sub.role, t.Config.Main, p.port) {
+                t.subordinateof(t.Config.Subordinate.PublicIP, p.port, t.Config.Main.PrivateIP, fmt.Sprintf("%d", p.port))
+            }
         }
     }
     log.Println("Config file validated")
+    return
+}
+
+/*! \brief Returns true if the subordinate needs checking while the main is fine, for the holddown or failback
+*/
+func (t *tasks_c) watchSubordinate () bool {
+    return t.Config.Damping.Holddown > 0 || t.Config.Failback.enabled()
+}
+
+/*! \brief Checks both servers on the port, returns true if the main's down and the subordinate's ready to take over
+*/
+func (t *tasks_c) checkPort (port int) bool {
+    mainUp, mainOk := t.observe(t.Config.Main.PublicIP, port, true)   //check the main first
+    if mainOk {
+        if t.watchSubordinate() {   //so the damping and failback know how the subordinate's doing, they don't check it themselves
+            t.observe(t.Config.Subordinate.PublicIP, port, false)
+        }
+        return false
+    }
+
+    //if we're here it's cause we couldn't connect with the main redis server
+    //we want to make sure we can connect with the subordinate as well, otherwise there's no point
+    if subUp, subOk := t.observe(t.Config.Subordinate.PublicIP, port, false); !subOk {
+        t.alert("down", fmt.Sprintf("Lost connection to both main and subordinate on port %d", port))
+        return false
+    } else if !subUp {
+        return false    //it's answering again, but it hasn't been up for long enough to trust it yet
+    }
+
+    //ok, so at this point we couldn't connect to the main, but we could the subordinate
+    //i like to be careful here, so we keep checking the main every -r seconds until it's either back or it's failed enough times to be down
+    for n := t.detector(t.Config.Main.PublicIP, port).remaining(); n > 0 && mainUp && !mainOk; n-- {
+        select {
+        case <-t.done():
+            return false    //shutting down, this isn't the time to start a failover
+        case <-time.After(time.Second * time.Duration(t.Retry)):
+        }
+        mainUp, mainOk = t.observe(t.Config.Main.PublicIP, port, true)
+    }
+    return !mainUp
 }
 
 /*! \brief Main entry point.  Call this and it will check and handle the switch if needed
+    If we're paused we still check everything so the status stays current, we just won't switch
 */
 func (t *tasks_c) Check () (ret bool) {
-    for _, port := range t.Config.Ports {
-        if t.checkRedis(t.Config.Main.PublicIP, port, true) == false { //check the main first
-            //if we're here it's cause we couldn't connect with the main redis server
-            //we want to make sure we can connect with the subordinate as well, otherwise there's no point
-            if t.checkRedis(t.Config.Subordinate.PublicIP, port, false) {
-                //ok, so at this point we couldn't connect to the main, but we could the subordinate
-                //i like to be careful here, so i'm goign to try one more time for the main before we switch everything
-                //we passed in a -r flag to indicate the length of time to wait here before we check the main again
-                time.Sleep(time.Second * time.Duration(t.Retry))
-
-                if t.checkRedis(t.Config.Main.PublicIP, port, true) == false {
-                    //ok, let's switch
-                    log.Printf("Switching away from old main at %s:%d\n", t.Config.Main.PublicIP, port)
-                    ret = t.Switch()    //this actually handles switching
-                }
-            } else {
-                log.Println("Lost connection to both main and subordinate")
-            }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if t.stopping() { return false }
+
+    if err := t.discoverPorts(); err != nil {
+        log.Println(err)    //we'll keep going with the ports we have
+    }
+    ret = t.syncState()
+    t.checkNginx()
+    switched := t.chaosTick()   //a forced switch, we still check everything after it
+    if t.failover() {
+        switched = true
+    }
+
+    if t.verifyRoles() {    //make sure nobody's changed the roles out from under us
+        switched = true
+    }
+    if !switched && !t.stopping() && t.checkFailback(time.Now()) {  //give a switch a check to settle before switching back
+        switched = true
+    }
+    return ret || switched
+}
+
+/*! \brief Same as Check except all it does is fail over when the main's down, this is what subordinates run on their own
+    Split brains, failbacks and faults are left to the main toggles, since they can see more than we can
+*/
+func (t *tasks_c) Failover () bool {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if t.stopping() { return false }
+
+    ret := t.syncState()
+    t.checkNginx()
+    return t.failover() || ret
+}
+
+/*! \brief Checks every port and switches if the main's down on any of them, returns true if we switched
+    Callers need to be holding t.lock
+*/
+func (t *tasks_c) failover () (switched bool) {
+    //every port is checked at the same time, so one that's hung can't hold up failover on the others
+    for _, port := range t.Config.Ports {   //make the detectors up front, the checks only read the map
+        t.detector(t.Config.Main.PublicIP, port)
+        t.detector(t.Config.Subordinate.PublicIP, port)
+    }
+    failed := make([]bool, len(t.Config.Ports))
+    wg := new(sync.WaitGroup)
+    for i, port := range t.Config.Ports {
+        wg.Add(1)
+        go func (i, port int) {
+            defer wg.Done()
+            failed[i] = t.checkPort(port)
+        }(i, port)
+    }
+    wg.Wait()
+
+    for i, port := range t.Config.Ports {
+        if !failed[i] { continue }
+        if t.status.Paused() {
+            t.events.Add("paused", fmt.Sprintf("Main at %s:%d is down but automatic failover is paused", t.Config.Main.PublicIP, port))
+            continue
         }
+        if t.stopping() {
+            t.events.Add("shutdown", fmt.Sprintf("Main at %s:%d is down but we're shutting down, leaving it to the next toggle", t.Config.Main.PublicIP, port))
+            break
+        }
+        if reason := t.damped(time.Now()); len(reason) > 0 {
+            t.events.Add("damped", fmt.Sprintf("Main at %s:%d is down but we're holding off switching :: %s", t.Config.Main.PublicIP, port, reason))
+            continue
+        }
+        //ok, let's switch, this moves every port so we're done after it
+        t.events.Add("failover", fmt.Sprintf("Switching away from old main at %s:%d", t.Config.Main.PublicIP, port))
+        from := t.Config.Main.PublicIP
+        if t.switchServers() {  //this actually handles switching
+            t.failedFrom = from
+            t.recordSwitch(time.Now())
+            switched = true
+        }
+        break
     }
     return
 }
@@ -161,36 +523,115 @@ func (t *tasks_c) Check () (ret bool) {
     we need to tell redis that it's now the main, which we'll do first cause it requires connecting to another machine
     and then we need to update the nginx load balancer to switch the reverse proxy to the new subordinate ip address
     and of course once that's done we want to update our config file to reflect the fact that the main and subordinate has switched
+    Callers need to be holding t.lock
 */
-func (t *tasks_c) Switch () bool {
-    var err error
-    for _, port := range t.Config.Ports {
-        err = t.subordinateof(t.Config.Subordinate.PublicIP, port, "no", "one")   //special no one for indicating it's a main
-        if err == nil {
-            //now we need to keep trying to talk to the main server and to let it know it's no longer the main
-            t.mainToSubordinate(t.Config.Main.PublicIP, t.Config.Subordinate.PrivateIP, port)
-        } else {
-            break   //don't do anymore, we're done
+func (t *tasks_c) switchServers () bool {
+    t.status.Begin("switch")
+    defer t.status.End()
+
+    j, err := t.beginSwitch("switch")
+    if err != nil {
+        t.events.Add("switch", err.Error())
+        return false
+    }
+    for _, port := range j.Ports {
+        if err := t.promote(j.To.PublicIP, port); err != nil {
+            //put back the ports we did promote, so everything's still on the old main like nginx and our config say
+            if rerr := t.rollback(j, j.Promoted); rerr != nil {
+                t.alert("error", fmt.Sprintf("Unable to promote subordinate to main on port %d, or roll back the others, we're in bad shape: %s, %s", port, err.Error(), rerr.Error())) //this is really bad
+            } else {
+                t.alert("error", fmt.Sprintf("Unable to promote subordinate to main on port %d, rolled back :: %s", port, err.Error()))
+            }
+            t.unclaimState(j)
+            t.clearJournal()    //the role checks deal with anything we couldn't put back
+            return false
         }
+        j.Promoted = append(j.Promoted, port)
+        t.writeJournal(j)
     }
 
-    if err == nil { //if this worked, then we're committed
-        //now update ngnix
-        t.nginx.Set(t.Config.Subordinate.PublicIP, t.Config.Ports)
+    //if this worked, then we're committed
+    t.commit(j)
+    t.events.Add("switch", fmt.Sprintf("Switch completed to new main at %s", j.To.PublicIP))  //we're done
+    return true //indicates we need to write this new update to the config file
+}
+
+/*! \brief Switches the main and subordinate, this is the manual version that's triggered by a signal or the admin api
+*/
+func (t *tasks_c) Switch () bool {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    return t.switchServers()
+}
 
-        log.Printf("Switch completed to new main at %s\n", t.Config.Subordinate.PublicIP)  //we're done
-        t.Config.Main, t.Config.Subordinate = t.Config.Subordinate, t.Config.Main   //switch the values so we know which is the main and which is the subordinate now
-        return true //indicates we need to write this new update to the config file
+/*! \brief Same as Switch, except it won't wait if a check or switch is already running
+    The first return is false if we couldn't start because something else was in progress
+*/
+func (t *tasks_c) TrySwitch () (started, switched bool) {
+    if !t.lock.TryLock() { return false, false }
+    defer t.lock.Unlock()
+    return true, t.switchServers()
+}
+
+/*! \brief Suspends or resumes automatic failover, checks still run so the status stays current
+*/
+func (t *tasks_c) Pause (paused bool) {
+    t.status.SetPaused(paused)
+    if paused {
+        t.events.Add("pause", "Automatic failover paused")
     } else {
-        log.Printf("Unable to promote subordinate to main, we're in bad shape: %s \n", err.Error()) //this is really bad
+        t.events.Add("resume", "Automatic failover resumed")
+    }
+}
+
+/*! \brief Writes our current config to the file, or records what would change in it if this is a dry run
+*/
+func (t *tasks_c) WriteConfig (fileLoc string) {
+    config := t.CurrentConfig()
+    if t.Plan != nil {
+        t.Plan.config(fileLoc, config)
+        return
     }
-    return false    //this is bad
+    writeConfig(&config, fileLoc)
+}
+
+/*! \brief Stops any demotions still running and closes every connection we're holding open to the redis servers
+*/
+func (t *tasks_c) Close () {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    t.demoter.stopAll()
+    t.conns.closeAll()
+}
+
+/*! \brief Returns the recent history of switches, failures and pauses, oldest first
+*/
+func (t *tasks_c) History () []event_t {
+    return t.events.List()
+}
+
+/*! \brief Returns a copy of the config that's safe to use while checks are running
+*/
+func (t *tasks_c) CurrentConfig () appConfig_t {
+    t.cfgLock.RLock()
+    defer t.cfgLock.RUnlock()
+    return *t.Config
+}
+
+/*! \brief Returns the current health, roles and anything that's in progress
+*/
+func (t *tasks_c) Status () status_t {
+    ret := t.status.Report(t.CurrentConfig())
+    ret.Connections = t.conns.report()
+    ret.Faults = t.Faults()
+    ret.Demotions = t.demoter.report()
+    return ret
 }
 
 /*! \brief This gets the current settings from the main ip and port for redis
-    This will return ip, port, error
+    The token is optional, with it the main includes its state backend
 */
-func (t *tasks_c) SubordinateCheck (ip string, port int) (config appConfig_t, err error) {
+func (t *tasks_c) SubordinateCheck (ip string, port int, token string) (config appConfig_t, err error) {
     //we need to do a get request from the main to see what the settings are
     req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d", ip, port), nil)
     if err != nil {
@@ -200,7 +641,8 @@ func (t *tasks_c) SubordinateCheck (ip string, port int) (config appConfig_t, er
     
     //req.Header.Set("X-Custom-Header", "myvalue")
     req.Header.Set("Accept", "application/json")
-    client := &http.Client{}
+    if len(token) > 0 { req.Header.Set("Authorization", "Bearer " + token) }
+    client := &http.Client{ Timeout: time.Second * 5 }  //don't let a hung main hold us up from trying the next one
     
     resp, err := client.Do(req)
     if err != nil {
@@ -0,0 +1,267 @@
+package main
+
+import (
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/NathanRThomas/redisToggle/redis"
+    "github.com/NathanRThomas/redisToggle/redis/redistest"
+    "github.com/NathanRThomas/redisToggle/store"
+)
+
+const (
+    testMain    = "10.0.0.1"
+    testSub     = "10.0.0.2"
+)
+
+//builds tasks against pretend servers, the main is a main and the subordinate replicates from it on every port
+func newTestTasks (t *testing.T, ports ...int) (*tasks_c, *redistest.FakeNetwork_c) {
+    t.Helper()
+    network := &redistest.FakeNetwork_c{}
+    config := &appConfig_t{
+        Main:           server_t{ PublicIP: testMain, PrivateIP: testMain },
+        Subordinate:    server_t{ PublicIP: testSub, PrivateIP: testSub },
+        Ports:          ports,
+    }
+    for _, port := range ports {
+        network.Server(testSub, port).SetRole(redis.Role_t{ MainHost: testMain, MainPort: port, LinkUp: true })
+    }
+
+    tasks := &tasks_c{ Config: config, TestingFlag: true, Dialer: network.Dial, NginxDir: t.TempDir() }
+    tasks.Journal = filepath.Join(tasks.NginxDir, "toggle.journal")
+    tasks.nginx.TestingFlag = true
+    tasks.nginx.Dir = tasks.NginxDir
+    return tasks, network
+}
+
+func hasEvent (tasks *tasks_c, kind string) bool {
+    for _, e := range tasks.History() {
+        if e.Kind == kind { return true }
+    }
+    return false
+}
+
+func hasCall (s *redistest.FakeServer_c, call string) bool {
+    for _, c := range s.Calls() {
+        if c == call { return true }
+    }
+    return false
+}
+
+//waits for the old main to be demoted in the background
+func waitForRole (t *testing.T, s *redistest.FakeServer_c, mainHost string, port int) {
+    t.Helper()
+    deadline := time.Now().Add(time.Second * 5)
+    for time.Now().Before(deadline) {
+        if role := s.Role(); !role.Main && role.MainHost == mainHost && role.MainPort == port { return }
+        time.Sleep(time.Millisecond * 10)
+    }
+    t.Fatalf("Server never started replicating from %s:%d, role is %+v", mainHost, port, s.Role())
+}
+
+func TestMain (m *testing.M) {
+    demoteRetry = time.Millisecond * 10
+    maxDemoteRetry = time.Millisecond * 50
+    promoteRetry = time.Millisecond * 10
+    m.Run()
+}
+
+func TestCheckHealthy (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+
+    if tasks.Check() { t.Fatal("Check switched with both servers healthy") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    for _, port := range []int{ 6379, 6380 } {
+        if calls := network.Server(testMain, port).Calls(); len(calls) > 0 { t.Fatalf("Main on %d was changed: %v", port, calls) }
+        if calls := network.Server(testSub, port).Calls(); len(calls) > 0 { t.Fatalf("Subordinate on %d was changed: %v", port, calls) }
+    }
+}
+
+func TestCheckFailover (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    for _, port := range []int{ 6379, 6380 } {
+        network.Server(testMain, port).SetDown(true)
+    }
+
+    if !tasks.Check() { t.Fatal("Check didn't switch with the main down") }
+    if tasks.Config.Main.PublicIP != testSub || tasks.Config.Subordinate.PublicIP != testMain {
+        t.Fatalf("Config wasn't swapped: main %s, subordinate %s", tasks.Config.Main.PublicIP, tasks.Config.Subordinate.PublicIP)
+    }
+    if !hasEvent(tasks, "failover") || !hasEvent(tasks, "switch") { t.Fatalf("Missing failover events: %+v", tasks.History()) }
+
+    for _, port := range []int{ 6379, 6380 } {
+        if !network.Server(testSub, port).Role().Main { t.Fatalf("Subordinate on %d wasn't promoted", port) }
+    }
+
+    //the old main keeps getting retried until it's back, then it replicates from the new main
+    for _, port := range []int{ 6379, 6380 } {
+        network.Server(testMain, port).SetDown(false)
+    }
+    for _, port := range []int{ 6379, 6380 } {
+        waitForRole(t, network.Server(testMain, port), testSub, port)
+    }
+}
+
+func TestCheckOnePortDown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    network.Server(testMain, 6380).SetDown(true)
+
+    if !tasks.Check() { t.Fatal("Check didn't switch with the main down on one port") }
+    for _, port := range []int{ 6379, 6380 } {    //every port moves together
+        if !network.Server(testSub, port).Role().Main { t.Fatalf("Subordinate on %d wasn't promoted", port) }
+    }
+    waitForRole(t, network.Server(testMain, 6379), testSub, 6379)
+}
+
+func TestCheckBothDown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetDown(true)
+    network.Server(testSub, 6379).SetDown(true)
+
+    if tasks.Check() { t.Fatal("Check switched to a subordinate that's down") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if !hasEvent(tasks, "down") { t.Fatal("No alert with both servers down") }
+}
+
+func TestCheckPaused (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetDown(true)
+    tasks.Pause(true)
+
+    if tasks.Check() { t.Fatal("Check switched while paused") }
+    if !hasEvent(tasks, "paused") { t.Fatal("No event for the failover we skipped") }
+    if network.Server(testSub, 6379).Role().Main { t.Fatal("Subordinate was promoted while paused") }
+}
+
+func TestCheckReadOnlyMain (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetReadOnly(true)
+
+    if !tasks.Check() { t.Fatal("Check didn't switch away from a main that can't be written to") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+}
+
+func TestCheckDemotedMain (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    main := network.Server(testMain, 6379)
+    main.SetRole(redis.Role_t{ MainHost: testSub, MainPort: 6379, LinkUp: true })    //someone pointed it at the subordinate by hand
+
+    if tasks.Check() { t.Fatal("Check switched when the main could be reset") }
+    if !hasCall(main, "SLAVEOF no one") { t.Fatalf("Main wasn't reset: %v", main.Calls()) }
+    if !main.Role().Main { t.Fatal("Main isn't the main again") }
+    if !hasEvent(tasks, "degraded") { t.Fatal("No alert for the main needing to be reset") }
+}
+
+func TestCheckWanderingSubordinate (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    sub := network.Server(testSub, 6379)
+    sub.SetRole(redis.Role_t{ MainHost: "10.0.0.9", MainPort: 6379, LinkUp: true })
+
+    tasks.Check()
+    if role := sub.Role(); role.MainHost != testMain || role.MainPort != 6379 { t.Fatalf("Subordinate wasn't pointed back at the main: %+v", role) }
+}
+
+func TestSwitch (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+
+    if !tasks.Switch() { t.Fatal("Switch failed with both servers up") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    for _, port := range []int{ 6379, 6380 } {
+        if !network.Server(testSub, port).Role().Main { t.Fatalf("Subordinate on %d wasn't promoted", port) }
+        waitForRole(t, network.Server(testMain, port), testSub, port)
+    }
+}
+
+func TestSwitchSubordinateDown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testSub, 6379).SetDown(true)
+
+    if tasks.Switch() { t.Fatal("Switch succeeded with the subordinate down") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    if !hasEvent(tasks, "error") { t.Fatal("No alert for the failed switch") }
+}
+
+func TestSwitchRollsBack (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379, 6380)
+    network.Server(testSub, 6380).SetDown(true)
+
+    if tasks.Switch() { t.Fatal("Switch succeeded with the subordinate down on one port") }
+    if tasks.Config.Main.PublicIP != testMain { t.Fatalf("Main changed to %s", tasks.Config.Main.PublicIP) }
+    sub := network.Server(testSub, 6379)
+    if role := sub.Role(); role.Main || role.MainHost != testMain { t.Fatalf("Promoted port wasn't rolled back: %+v", role) }
+    if !hasCall(sub, "SLAVEOF no one") { t.Fatal("First port was never promoted") }
+    if j, err := readJournal(tasks.Journal); j != nil || err != nil { t.Fatalf("Journal was left behind: %+v %v", j, err) }
+}
+
+func TestSwitchStaleState (t *testing.T) {
+    shared := &store.Memory_c{}
+    tasks, network := newTestTasks(t, 6379)
+    other, _ := newTestTasks(t, 6379)
+    other.Dialer = network.Dial
+    tasks.Store, other.Store = shared, shared
+    tasks.syncState()
+    other.syncState()   //both toggle hosts have seen the same state
+
+    if !tasks.Switch() { t.Fatal("First switch failed") }
+    calls := len(network.Server(testSub, 6379).Calls())
+    if other.Switch() { t.Fatal("Second toggle host switched on a stale state") }
+    if other.Config.Main.PublicIP != testMain || len(network.Server(testSub, 6379).Calls()) != calls { t.Fatal("Second toggle host touched redis") }
+
+    if state, _ := shared.Load(); state.Main != testSub { t.Fatalf("State was overwritten: %+v", state) }
+    if other.syncState(); other.Config.Main.PublicIP != testSub { t.Fatal("Second toggle host didn't follow the state store") }
+}
+
+func TestSwitchRollsBackState (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    tasks.Store = &store.Memory_c{}
+    tasks.syncState()
+    network.Server(testSub, 6379).SetDown(true)
+
+    if tasks.Switch() { t.Fatal("Switch succeeded with the subordinate down") }
+    if state, _ := tasks.Store.Load(); state.Main != testMain { t.Fatalf("Claimed switch wasn't put back in the state store: %+v", state) }
+}
+
+func TestTrySwitchBusy (t *testing.T) {
+    tasks, _ := newTestTasks(t, 6379)
+    tasks.lock.Lock()
+    started, _ := tasks.TrySwitch()
+    tasks.lock.Unlock()
+    if started { t.Fatal("TrySwitch started while something else held the lock") }
+}
+
+func TestValidateConfigHealthy (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+
+    if tasks.ValidateConfig() { t.Fatal("ValidateConfig wants the config rewritten when nothing changed") }
+    if calls := network.Server(testSub, 6379).Calls(); len(calls) > 0 { t.Fatalf("Subordinate was changed when it was already right: %v", calls) }
+}
+
+func TestValidateConfigStale (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testSub, 6379).SetRole(redis.Role_t{ Main: true })
+    network.Server(testMain, 6379).SetRole(redis.Role_t{ MainHost: testSub, MainPort: 6379, LinkUp: true })
+
+    if !tasks.ValidateConfig() { t.Fatal("ValidateConfig didn't follow the real topology") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    if !hasEvent(tasks, "reconcile") { t.Fatal("No reconcile event") }
+    if calls := network.Server(testSub, 6379).Calls(); len(calls) > 0 { t.Fatalf("The real main was changed: %v", calls) }
+}
+
+func TestValidateConfigMainDown (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    network.Server(testMain, 6379).SetDown(true)
+
+    if !tasks.ValidateConfig() { t.Fatal("ValidateConfig didn't switch with the main down") }
+    if tasks.Config.Main.PublicIP != testSub { t.Fatalf("Main is still %s", tasks.Config.Main.PublicIP) }
+    if !network.Server(testSub, 6379).Role().Main { t.Fatal("Subordinate wasn't promoted") }
+}
+
+func TestValidateConfigFixesSubordinate (t *testing.T) {
+    tasks, network := newTestTasks(t, 6379)
+    sub := network.Server(testSub, 6379)
+    sub.SetRole(redis.Role_t{ MainHost: "10.0.0.9", MainPort: 6379 })
+
+    tasks.ValidateConfig()
+    if role := sub.Role(); role.MainHost != testMain || role.MainPort != 6379 { t.Fatalf("Subordinate wasn't pointed at the main: %+v", role) }
+}